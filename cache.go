@@ -0,0 +1,100 @@
+package luna
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+// Purge drops the cached pages of paths, every variant of them, and returns how many it dropped.
+// Like every purge it is published on the CacheBus of Config.PageCache, so the other replicas drop them too
+func (e *Engine) Purge(paths ...string) int {
+	return e.invalidate(pkg.Invalidation{Paths: paths})
+}
+
+// PurgeRoute drops the cached pages whose path matches a route pattern such as "/decks/:id"
+func (e *Engine) PurgeRoute(pattern string) int {
+	return e.invalidate(pkg.Invalidation{Routes: []string{pattern}})
+}
+
+// InvalidateTags drops the cached pages carrying one of tags, from the CacheTags of their route
+// or attached to their render with pkg.CacheTag
+func (e *Engine) InvalidateTags(tags ...string) int {
+	return e.invalidate(pkg.Invalidation{Tags: tags})
+}
+
+// PurgeAll drops every cached page
+func (e *Engine) PurgeAll() int {
+	return e.invalidate(pkg.Invalidation{All: true})
+}
+
+func (e *Engine) invalidate(invalidation pkg.Invalidation) int {
+	current := e.frontend.Load()
+	if current == nil {
+		return 0
+	}
+	return current.cache.Invalidate(invalidation)
+}
+
+// CacheEntries lists the cached pages ordered by ID
+func (e *Engine) CacheEntries() []pkg.CacheEntry {
+	current := e.frontend.Load()
+	if current == nil {
+		return nil
+	}
+	caches := current.cache.Entries(func(pkg.Cache) bool { return true })
+	entries := make([]pkg.CacheEntry, len(caches))
+	for i, cache := range caches {
+		entries[i] = cache.Entry()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+	return entries
+}
+
+// CacheStats returns the size and counters of the page cache, they start over with every build
+func (e *Engine) CacheStats() pkg.CacheStats {
+	current := e.frontend.Load()
+	if current == nil {
+		return pkg.CacheStats{}
+	}
+	return current.cache.Stats()
+}
+
+// CacheAdmin mounts a JSON API for the page cache under prefix:
+//
+//	GET    prefix/stats    cache stats
+//	GET    prefix/entries  cached pages
+//	DELETE prefix/entries  purge by ?path=, ?route=, ?tag= or ?all=true, answers {"purged": n}
+//
+// The API exposes every cached page, protect it with middleware such as basic auth
+func (e *Engine) CacheAdmin(prefix string, middleware ...echo.MiddlewareFunc) {
+	if len(middleware) == 0 {
+		e.Logger.Warn().Str("prefix", prefix).Msg("Cache admin API mounted without middleware, anyone can purge the cache")
+	}
+	admin := e.Server.Group(prefix, middleware...)
+	admin.GET("/stats", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, e.CacheStats())
+	})
+	admin.GET("/entries", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, e.CacheEntries())
+	})
+	admin.DELETE("/entries", func(c echo.Context) error {
+		query := c.QueryParams()
+		var purged int
+		switch {
+		case query.Has("path"):
+			purged = e.Purge(query["path"]...)
+		case query.Has("route"):
+			purged = e.invalidate(pkg.Invalidation{Routes: query["route"]})
+		case query.Has("tag"):
+			purged = e.InvalidateTags(query["tag"]...)
+		case query.Get("all") == "true":
+			purged = e.PurgeAll()
+		default:
+			return echo.NewHTTPError(http.StatusBadRequest, "purge needs a path, route, tag or all=true")
+		}
+		return c.JSON(http.StatusOK, map[string]int{"purged": purged})
+	})
+}
@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/Djancyp/luna/internal/env"
+	"github.com/Djancyp/luna/pkg"
+	"github.com/spf13/cobra"
+)
+
+var (
+	buildOut      string
+	buildServer   string
+	buildClient   string
+	buildTailwind bool
+	buildRoot     string
+)
+
+var buildCmd = &cobra.Command{
+	Use:   "build [package]",
+	Short: "Write the production bundles to a directory",
+	Long: `This command writes the client and server bundles, CSS and a manifest to the output directory.
+Point Config.BuildPath at that directory so the production binary loads them without Node or the frontend sources.
+With --server and --client the entry points are bundled directly, otherwise the app is run in build mode
+and its Config is used. An app that embeds the output with go:embed does not compile before the first build, use the flags for it`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		out, err := filepath.Abs(buildOut)
+		if err != nil {
+			return err
+		}
+		if buildServer != "" || buildClient != "" {
+			if buildServer == "" || buildClient == "" || len(args) > 0 {
+				return errors.New("--server and --client go together and replace the package")
+			}
+			return pkg.Build(out, pkg.BuildOptions{
+				ServerEntryPoint: buildServer,
+				ClientEntryPoint: buildClient,
+				TailwindCSS:      buildTailwind,
+				RootPath:         buildRoot,
+			})
+		}
+
+		target := "."
+		if len(args) == 1 {
+			target = args[0]
+		}
+		run := exec.Command("go", "run", target)
+		run.Stdout = os.Stdout
+		run.Stderr = os.Stderr
+		run.Env = append(os.Environ(), env.Build+"="+out)
+		return run.Run()
+	},
+}
+
+func init() {
+	buildCmd.Flags().StringVarP(&buildOut, "out", "o", "dist", "directory the bundles are written to")
+	buildCmd.Flags().StringVar(&buildServer, "server", "", "server entry point, Config.ServerEntryPoint of the app")
+	buildCmd.Flags().StringVar(&buildClient, "client", "", "client entry point, Config.ClientEntryPoint of the app")
+	buildCmd.Flags().BoolVar(&buildTailwind, "tailwind", false, "append the Tailwind output, Config.TailwindCSS of the app")
+	buildCmd.Flags().StringVar(&buildRoot, "root", ".", "directory Tailwind runs in, Config.RootPath of the app")
+}
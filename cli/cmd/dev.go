@@ -0,0 +1,296 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Djancyp/luna/internal/env"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+)
+
+var (
+	devAddr     string
+	devWSPath   string
+	devDebounce time.Duration
+)
+
+var devCmd = &cobra.Command{
+	Use:   "dev [package]",
+	Short: "Run the app and restart it when Go files change",
+	Long: `This command builds and runs the app behind a proxy, rebuilding and restarting it when Go files change.
+The proxy keeps the hot reload websocket of open tabs up across restarts and reloads them once the new process answers`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		target := "."
+		if len(args) == 1 {
+			target = args[0]
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+		defer stop()
+		return runDev(ctx, target)
+	},
+}
+
+func init() {
+	devCmd.Flags().StringVar(&devAddr, "addr", ":3000", "address the dev proxy listens on")
+	devCmd.Flags().StringVar(&devWSPath, "ws-path", env.HotReloadPath, "path of the hot reload websocket, Config.HotReloadPath of the app")
+	devCmd.Flags().DurationVar(&devDebounce, "debounce", 200*time.Millisecond, "quiet period before a burst of changes restarts the app")
+}
+
+func runDev(ctx context.Context, target string) error {
+	appAddr, err := freeAddr()
+	if err != nil {
+		return err
+	}
+	dir, err := os.MkdirTemp("", "luna-dev")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	bin := filepath.Join(dir, "app")
+	if runtime.GOOS == "windows" {
+		bin += ".exe"
+	}
+	d := &devServer{
+		target:  target,
+		bin:     bin,
+		appAddr: appAddr,
+		wsPath:  devWSPath,
+		ready:   make(chan struct{}),
+		clients: make(map[*devClient]struct{}),
+	}
+	d.proxy = httputil.NewSingleHostReverseProxy(&url.URL{Scheme: "http", Host: appAddr})
+	defer d.stop()
+
+	if err := d.restart(); err != nil {
+		fmt.Fprintf(os.Stderr, "luna dev: %v\n", err)
+	}
+
+	server := &http.Server{Addr: devAddr, Handler: d}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go d.watch(ctx, ".")
+
+	fmt.Printf("luna dev: serving on %s\n", devAddr)
+	if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// freeAddr returns a loopback address with a port nothing listens on
+func freeAddr() (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	defer l.Close()
+	return l.Addr().String(), nil
+}
+
+// devServer supervises the app process and proxies requests to it
+type devServer struct {
+	target  string
+	bin     string
+	appAddr string
+	wsPath  string
+	proxy   *httputil.ReverseProxy
+
+	mu      sync.Mutex
+	app     *exec.Cmd
+	exited  chan struct{} // closed once the running app exited
+	ready   chan struct{} // closed once the running app answers requests
+	clients map[*devClient]struct{}
+}
+
+// watch restarts the app once changes to Go files under dir have settled
+func (d *devServer) watch(ctx context.Context, dir string) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "luna dev: failed to start watcher: %v\n", err)
+		return
+	}
+	defer watcher.Close()
+
+	addDirs := func(root string) {
+		filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil || !fi.IsDir() {
+				return nil
+			}
+			name := fi.Name()
+			if path != root && (name == "node_modules" || name == "vendor" || strings.HasPrefix(name, ".")) {
+				return filepath.SkipDir
+			}
+			watcher.Add(path)
+			return nil
+		})
+	}
+	addDirs(dir)
+
+	var restart <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Has(fsnotify.Create) {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					addDirs(event.Name)
+				}
+			}
+			base := filepath.Base(event.Name)
+			if event.Op == fsnotify.Chmod || (filepath.Ext(base) != ".go" && base != "go.mod" && base != "go.sum") {
+				continue
+			}
+			restart = time.After(devDebounce)
+		case <-restart:
+			restart = nil
+			fmt.Println("luna dev: Go files changed, restarting...")
+			if err := d.restart(); err != nil {
+				fmt.Fprintf(os.Stderr, "luna dev: %v\n", err)
+				continue
+			}
+			d.reloadClients()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "luna dev: error watching files: %v\n", err)
+		}
+	}
+}
+
+// restart builds the app and replaces the running process once the build succeeded.
+// A failed build keeps the previous process running
+func (d *devServer) restart() error {
+	next := d.bin + ".next"
+	build := exec.Command("go", "build", "-o", next, d.target)
+	build.Stdout = os.Stdout
+	build.Stderr = os.Stderr
+	if err := build.Run(); err != nil {
+		return fmt.Errorf("build failed: %w", err)
+	}
+
+	d.mu.Lock()
+	select {
+	case <-d.ready:
+		d.ready = make(chan struct{})
+	default:
+	}
+	ready := d.ready
+	d.mu.Unlock()
+
+	d.stop()
+	if err := os.Rename(next, d.bin); err != nil {
+		return err
+	}
+
+	app := exec.Command(d.bin)
+	app.Stdout = os.Stdout
+	app.Stderr = os.Stderr
+	app.Env = append(os.Environ(), env.DevAddr+"="+d.appAddr)
+	if err := app.Start(); err != nil {
+		return fmt.Errorf("starting app: %w", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		app.Wait()
+		close(exited)
+	}()
+	d.mu.Lock()
+	d.app, d.exited = app, exited
+	d.mu.Unlock()
+
+	if err := d.waitHealthy(exited, 30*time.Second); err != nil {
+		return err
+	}
+	close(ready)
+	return nil
+}
+
+// waitHealthy polls the app until it answers any HTTP request
+func (d *devServer) waitHealthy(exited <-chan struct{}, timeout time.Duration) error {
+	client := &http.Client{Timeout: time.Second}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			return errors.New("app exited before it was ready")
+		default:
+		}
+		if res, err := client.Get("http://" + d.appAddr + "/"); err == nil {
+			res.Body.Close()
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return fmt.Errorf("app did not answer on %s within %s", d.appAddr, timeout)
+}
+
+// stop interrupts the running app and kills it if it does not exit in time
+func (d *devServer) stop() {
+	d.mu.Lock()
+	app, exited := d.app, d.exited
+	d.app, d.exited = nil, nil
+	d.mu.Unlock()
+	if app == nil {
+		return
+	}
+
+	if err := app.Process.Signal(os.Interrupt); err != nil {
+		app.Process.Kill()
+	}
+	select {
+	case <-exited:
+	case <-time.After(5 * time.Second):
+		app.Process.Kill()
+		<-exited
+	}
+}
+
+// waitReady blocks until the app answers requests or ctx is done
+func (d *devServer) waitReady(ctx context.Context) error {
+	d.mu.Lock()
+	ready := d.ready
+	d.mu.Unlock()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *devServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == d.wsPath {
+		d.serveWebsocket(w, r)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 30*time.Second)
+	defer cancel()
+	if err := d.waitReady(ctx); err != nil {
+		http.Error(w, "luna dev: the app is not running", http.StatusBadGateway)
+		return
+	}
+	d.proxy.ServeHTTP(w, r)
+}
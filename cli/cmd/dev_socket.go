@@ -0,0 +1,109 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var devUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// devClient is a browser tab connected to the hot reload websocket of the proxy.
+// The proxy relays messages from the app and outlives app restarts
+type devClient struct {
+	conn    *websocket.Conn
+	routeID []byte
+	mu      sync.Mutex // serializes writes from the relay and reloadClients
+}
+
+func (c *devClient) write(data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, data)
+}
+
+// serveWebsocket keeps a browser connection open and relays the app's hot reload messages to it
+func (d *devServer) serveWebsocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := devUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, routeID, err := conn.ReadMessage()
+	if err != nil {
+		return
+	}
+	client := &devClient{conn: conn, routeID: routeID}
+	d.mu.Lock()
+	d.clients[client] = struct{}{}
+	d.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		d.mu.Lock()
+		delete(d.clients, client)
+		d.mu.Unlock()
+	}()
+	go d.relay(ctx, client)
+
+	// The page only sends its route, reading detects when the tab goes away
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// relay connects to the app's websocket on behalf of client and copies its messages,
+// reconnecting whenever the app has been restarted
+func (d *devServer) relay(ctx context.Context, client *devClient) {
+	for {
+		if err := d.waitReady(ctx); err != nil {
+			return
+		}
+		upstream, _, err := websocket.DefaultDialer.DialContext(ctx, "ws://"+d.appAddr+d.wsPath, nil)
+		if err == nil {
+			stop := context.AfterFunc(ctx, func() { upstream.Close() })
+			if err := upstream.WriteMessage(websocket.TextMessage, client.routeID); err == nil {
+				for {
+					_, data, err := upstream.ReadMessage()
+					if err != nil || client.write(data) != nil {
+						break
+					}
+				}
+			}
+			stop()
+			upstream.Close()
+		}
+
+		// The app went away or is restarting, try again shortly
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// reloadClients tells every open tab to reload after the app was restarted
+func (d *devServer) reloadClients() {
+	d.mu.Lock()
+	clients := make([]*devClient, 0, len(d.clients))
+	for client := range d.clients {
+		clients = append(clients, client)
+	}
+	d.mu.Unlock()
+
+	for _, client := range clients {
+		client.write([]byte(`{"type":"reload"}`))
+	}
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/Djancyp/luna/internal/env"
+	"github.com/spf13/cobra"
+)
+
+var exportOut string
+
+var exportCmd = &cobra.Command{
+	Use:   "export [package]",
+	Short: "Render the static routes to HTML files",
+	Long: `This command runs the app in export mode, which renders every static route and every StaticPaths path to an index.html.
+The client bundle and the assets and public files are copied next to the pages, so the directory can be hosted on any static server or CDN`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		target := "."
+		if len(args) == 1 {
+			target = args[0]
+		}
+		out, err := filepath.Abs(exportOut)
+		if err != nil {
+			return err
+		}
+		run := exec.Command("go", "run", target)
+		run.Stdout = os.Stdout
+		run.Stderr = os.Stderr
+		run.Env = append(os.Environ(), env.Export+"="+out)
+		return run.Run()
+	},
+}
+
+func init() {
+	exportCmd.Flags().StringVarP(&exportOut, "out", "o", "out", "directory the site is exported to")
+}
@@ -43,4 +43,7 @@ func init() {
 
 	// rootCmd.AddCommand(addCmd)
 	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(devCmd)
+	rootCmd.AddCommand(buildCmd)
+	rootCmd.AddCommand(exportCmd)
 }
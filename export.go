@@ -0,0 +1,111 @@
+package luna
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Djancyp/luna/internal/env"
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+// ExportEnv is set by `luna export` to the directory Start exports the site to instead of serving
+const ExportEnv = env.Export
+
+// exportKey marks the requests Export renders, their pages leave out the dev script
+type exportKey struct{}
+
+// devPage reports whether the page for c gets the hot reload script
+func (e *Engine) devPage(c echo.Context) bool {
+	return e.Config.ENV != "production" && c.Request().Context().Value(exportKey{}) == nil
+}
+
+// Export renders every static route, and every path returned by StaticPaths of a
+// parameterised route, to an index.html under dir. The client bundle, AssetsPath
+// and PublicPath are copied next to the pages so dir can be served by any static host
+func (e *Engine) Export(dir string) error {
+	if e.frontend.Load() == nil {
+		if err := e.InitializeFrontend(); err != nil {
+			return err
+		}
+	}
+
+	for _, route := range e.Config.Routes {
+		paths := []string{route.Path}
+		if route.StaticPaths != nil {
+			paths = route.StaticPaths()
+		} else if strings.ContainsAny(route.Path, ":*") {
+			e.Logger.Warn().Str("route", route.Path).Msg("Skipping parameterised route without StaticPaths")
+			continue
+		}
+		for _, path := range paths {
+			if err := e.exportPage(dir, path); err != nil {
+				return err
+			}
+		}
+	}
+
+	// The client bundle keeps its URLs, so the pages find it under AssetsPrefix
+	for name, content := range e.frontend.Load().client.Files {
+		if err := writeExport(filepath.Join(dir, filepath.FromSlash(pkg.AssetsPrefix), filepath.FromSlash(name)), content); err != nil {
+			return err
+		}
+	}
+	if err := e.exportDir(filepath.Join(dir, "assets"), e.Config.AssetsPath); err != nil {
+		return err
+	}
+	return e.exportDir(dir, e.Config.PublicPath)
+}
+
+// exportPage renders path through the server, middleware included, and writes it to dir
+func (e *Engine) exportPage(dir, path string) error {
+	ctx := context.WithValue(context.Background(), exportKey{}, true)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return fmt.Errorf("exporting %s: %w", path, err)
+	}
+	res := newResponseBuffer()
+	e.Server.ServeHTTP(res, req)
+	if res.status != http.StatusOK {
+		return fmt.Errorf("exporting %s: status %d", path, res.status)
+	}
+	file := filepath.Join(dir, filepath.FromSlash(strings.Trim(req.URL.Path, "/")), "index.html")
+	return writeExport(file, res.body.Bytes())
+}
+
+// exportDir copies the files of dir from Config.FS or the disk to out, a missing dir is skipped
+func (e *Engine) exportDir(out, dir string) error {
+	if dir == "" {
+		return nil
+	}
+	fsys, err := dirFS(e.Config, dir)
+	if err != nil {
+		return err
+	}
+	err = fs.WalkDir(fsys, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		return writeExport(filepath.Join(out, filepath.FromSlash(name)), content)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func writeExport(file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(file, content, 0644)
+}
@@ -0,0 +1,48 @@
+package luna
+
+import (
+	"sync/atomic"
+
+	"github.com/Djancyp/luna/pkg"
+)
+
+// ssrFallback applies the route's SSRFallback policy to a failed render.
+// It returns the HTML to put in the root, empty for a client-only render,
+// or the original error when the route has no fallback. lastGoodKey is the cache ID
+// the last good render was kept under, empty when the render is not shareable
+func (e *Engine) ssrFallback(route pkg.ReactRoute, path, lastGoodKey string, err error) (string, error) {
+	if route.SSRFallback == pkg.SSRFallbackFail {
+		return "", err
+	}
+
+	var html string
+	if lastGoodKey != "" {
+		if last, ok, _ := e.lastGood.Get(lastGoodKey); ok {
+			html = last.Body
+		}
+	}
+
+	count, _ := e.fallbacks.LoadOrStore(route.Path, new(atomic.Uint64))
+	count.(*atomic.Uint64).Add(1)
+	e.Logger.Warn().
+		Err(err).
+		Str("route", route.Path).
+		Str("path", path).
+		Str("fallback", route.SSRFallback.String()).
+		Bool("clientOnly", html == "").
+		Msg("Server render failed, serving fallback")
+	if e.Config.OnSSRFallback != nil {
+		e.Config.OnSSRFallback(route, path, err)
+	}
+	return html, nil
+}
+
+// SSRFallbacks returns how many times each route served its SSR fallback, keyed by route path
+func (e *Engine) SSRFallbacks() map[string]uint64 {
+	counts := make(map[string]uint64)
+	e.fallbacks.Range(func(route, count any) bool {
+		counts[route.(string)] = count.(*atomic.Uint64).Load()
+		return true
+	})
+	return counts
+}
@@ -0,0 +1,25 @@
+package luna
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dirFS returns dir inside Config.FS, or dir on disk when the config has no FS
+func dirFS(config Config, dir string) (fs.FS, error) {
+	if config.FS == nil {
+		if dir == "" {
+			dir = "."
+		}
+		return os.DirFS(dir), nil
+	}
+	return fs.Sub(config.FS, fsPath(dir))
+}
+
+// fsPath converts a path from the config to the unrooted, slash-separated form fs.FS expects
+func fsPath(name string) string {
+	return path.Clean(strings.TrimPrefix(filepath.ToSlash(name), "/"))
+}
@@ -1,17 +1,37 @@
 package luna
 
 import (
-	"fmt"
+	"encoding/json"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
+	"github.com/Djancyp/luna/internal/env"
+	"github.com/Djancyp/luna/pkg"
 	"github.com/fsnotify/fsnotify"
 	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog"
 )
 
+// Message types pushed to the dev script of every page
+const (
+	hotConnected = "connected" // sent once a client has registered
+	hotCSS       = "css"       // swap the client stylesheet for Path
+	hotUpdate    = "update"    // import the rebuilt client entry at Path without reloading the page
+	hotReload    = "reload"    // reload the page
+	hotError     = "error"     // show Errors in the overlay until the next successful build
+)
+
+// hotMessage is the JSON message sent over the hot reload websocket
+type hotMessage struct {
+	Type   string         `json:"type"`
+	Path   string         `json:"path,omitempty"`   // public URL of the rebuilt file
+	Errors []overlayError `json:"errors,omitempty"` // build or render errors of an error message
+}
+
 type HotReload struct {
 	engine           *Engine
 	logger           zerolog.Logger
@@ -28,60 +48,84 @@ func newHotReload(engine *Engine) *HotReload {
 	}
 }
 
-// Start starts the hot reload server and watcher
+// defaultHotReloadPath is where the websocket is mounted when Config.HotReloadPath is empty
+const defaultHotReloadPath = env.HotReloadPath
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// Start starts the file watcher
 func (hr *HotReload) Start(basedir string) {
-	go hr.startServer()
 	go hr.startWatcher(basedir)
 }
 
-// startServer starts the hot reload websocket server
-func (hr *HotReload) startServer() {
-	hr.logger.Info().Msgf("Hot reload websocket running on port %d", hr.engine.Config.HotReloadServerPort)
-	upgrader := websocket.Upgrader{
-		CheckOrigin: func(r *http.Request) bool {
-			return true
-		},
+// hotReloadPath returns the route the websocket is served from on Engine.Server
+func hotReloadPath(config Config) string {
+	if config.HotReloadPath != "" {
+		return config.HotReloadPath
 	}
-	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		ws, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			hr.logger.Err(err).Msg("Failed to upgrade websocket")
-			return
-		}
-		defer ws.Close() // Ensure connection is closed when the function exits
+	return defaultHotReloadPath
+}
 
-		_, routeID, err := ws.ReadMessage()
-		if err != nil {
-			hr.logger.Err(err).Msg("Failed to read routeID from websocket")
-			return
-		}
-		err = ws.WriteMessage(websocket.TextMessage, []byte("Connected"))
-		if err != nil {
-			hr.logger.Err(err).Msg("Failed to send 'Connected' message")
-			return
-		}
+// url returns the websocket URL for a page, seen from the client that requested it
+func (hr *HotReload) url(c echo.Context) string {
+	scheme := "ws"
+	if c.Scheme() == "https" {
+		scheme = "wss"
+	}
+	host := c.Request().Header.Get("X-Forwarded-Host")
+	if host == "" {
+		host = c.Request().Host
+	}
+	return scheme + "://" + host + hotReloadPath(hr.engine.Config)
+}
 
-		// Add client to connectedClients in a thread-safe manner
-		hr.mu.Lock()
-		hr.connectedClients[string(routeID)] = append(hr.connectedClients[string(routeID)], ws)
-		hr.mu.Unlock()
-
-		// Handle client disconnection
-		for {
-			_, _, err := ws.ReadMessage()
-			if err != nil {
-				hr.mu.Lock()
-				hr.removeClient(string(routeID), ws)
-				hr.mu.Unlock()
-				hr.logger.Info().Str("routeID", string(routeID)).Msg("Client disconnected")
-				break
-			}
-		}
-	})
+// serveWebsocket registers a page for hot reload messages until it disconnects.
+// The first message from the page is its path
+func (hr *HotReload) serveWebsocket(c echo.Context) error {
+	ws, err := upgrader.Upgrade(c.Response(), c.Request(), nil)
+	if err != nil {
+		hr.logger.Err(err).Msg("Failed to upgrade websocket")
+		return nil
+	}
+	defer ws.Close() // Ensure connection is closed when the function exits
 
-	err := http.ListenAndServe(fmt.Sprintf(":%d", hr.engine.Config.HotReloadServerPort), nil)
+	_, routeID, err := ws.ReadMessage()
 	if err != nil {
-		hr.logger.Err(err).Msg("Hot reload server quit unexpectedly")
+		hr.logger.Err(err).Msg("Failed to read routeID from websocket")
+		return nil
+	}
+	err = ws.WriteJSON(hotMessage{Type: hotConnected})
+	if err != nil {
+		hr.logger.Err(err).Msg("Failed to send 'Connected' message")
+		return nil
+	}
+	// A page loaded while the build is broken still serves the previous bundle
+	if current := hr.engine.frontend.Load(); current != nil && current.err != nil {
+		if err := ws.WriteJSON(hotMessage{Type: hotError, Errors: buildErrors(current.err)}); err != nil {
+			hr.logger.Err(err).Msg("Failed to send build errors")
+			return nil
+		}
+	}
+
+	// Add client to connectedClients in a thread-safe manner
+	hr.mu.Lock()
+	hr.connectedClients[string(routeID)] = append(hr.connectedClients[string(routeID)], ws)
+	hr.mu.Unlock()
+
+	// Handle client disconnection
+	for {
+		_, _, err := ws.ReadMessage()
+		if err != nil {
+			hr.mu.Lock()
+			hr.removeClient(string(routeID), ws)
+			hr.mu.Unlock()
+			hr.logger.Info().Str("routeID", string(routeID)).Msg("Client disconnected")
+			return nil
+		}
 	}
 }
 
@@ -99,7 +143,21 @@ func (hr *HotReload) removeClient(routeID string, ws *websocket.Conn) {
 	}
 }
 
-// startWatcher starts the file watcher
+// defaultWatchExclude keeps dependencies, VCS data and editor temp files from triggering rebuilds
+var defaultWatchExclude = []string{
+	"**/node_modules/**",
+	"**/.git/**",
+	"**/*.swp",
+	"**/*.swx",
+	"**/*~",
+	"**/.#*",
+	"**/4913", // vim probes directory permissions with this file
+}
+
+// defaultWatchDebounce is how long the watcher waits for a burst of events to settle
+const defaultWatchDebounce = 100 * time.Millisecond
+
+// startWatcher watches basedir and rebuilds once a burst of matching changes has settled
 func (hr *HotReload) startWatcher(basedir string) {
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
@@ -108,50 +166,161 @@ func (hr *HotReload) startWatcher(basedir string) {
 	}
 	defer watcher.Close()
 
-	// Walk through all files in the frontend directory and add them to the watcher
-	err = filepath.Walk(basedir, func(path string, fi os.FileInfo, err error) error {
+	hr.watchDir(watcher, basedir, basedir)
+
+	debounce := hr.engine.Config.WatchDebounce
+	if debounce <= 0 {
+		debounce = defaultWatchDebounce
+	}
+	var rebuild <-chan time.Time
+	var changed []string // files changed since the last rebuild
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op == fsnotify.Chmod || hr.excluded(basedir, event.Name) {
+				continue
+			}
+			// Directories created after the start are watched too, with what was written into them so far
+			if event.Has(fsnotify.Create) {
+				if fi, err := os.Stat(event.Name); err == nil && fi.IsDir() {
+					hr.watchDir(watcher, basedir, event.Name)
+				}
+			}
+			if !hr.included(basedir, event.Name) {
+				continue
+			}
+			changed = append(changed, event.Name)
+			rebuild = time.After(debounce)
+		case <-rebuild:
+			rebuild = nil
+			hr.logger.Info().Msg("Detected change, updating clients...")
+			hr.rebuild(changed)
+			changed = nil
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			hr.logger.Err(err).Msg("Error watching files")
+		}
+	}
+}
+
+// watchDir adds dir and every directory below it that is not excluded to the watcher
+func (hr *HotReload) watchDir(watcher *fsnotify.Watcher, basedir, dir string) {
+	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
 			hr.logger.Err(err).Msgf("Error accessing path: %s", path)
 			return nil
 		}
-		if fi.Mode().IsDir() {
-			if err := watcher.Add(path); err != nil {
-				hr.logger.Err(err).Msgf("Failed to add directory to watcher: %s", path)
-			}
+		if !fi.IsDir() {
+			return nil
+		}
+		if path != basedir && hr.excluded(basedir, path) {
+			return filepath.SkipDir
+		}
+		if err := watcher.Add(path); err != nil {
+			hr.logger.Err(err).Msgf("Failed to add directory to watcher: %s", path)
 		}
 		return nil
 	})
 	if err != nil {
 		hr.logger.Err(err).Msg("Failed to add files in directory to watcher")
-		return
 	}
+}
 
-	for {
-		select {
-		case event := <-watcher.Events:
-			if event.Op&fsnotify.Write == fsnotify.Write {
-				hr.logger.Info().Msg("Detected change, reloading clients...")
-				hr.engine.InitializeFrontend()
-				hr.reloadClients()
-			}
-		case err := <-watcher.Errors:
-			hr.logger.Err(err).Msg("Error watching files")
+// excluded reports whether name matches one of the exclude globs
+func (hr *HotReload) excluded(basedir, name string) bool {
+	rel := watchPath(basedir, name)
+	for _, pattern := range append(defaultWatchExclude, hr.engine.Config.WatchExclude...) {
+		if pkg.MatchGlob(pattern, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// included reports whether name matches one of the include globs, everything is included without any
+func (hr *HotReload) included(basedir, name string) bool {
+	if len(hr.engine.Config.WatchInclude) == 0 {
+		return true
+	}
+	rel := watchPath(basedir, name)
+	for _, pattern := range hr.engine.Config.WatchInclude {
+		if pkg.MatchGlob(pattern, rel) {
+			return true
 		}
 	}
+	return false
 }
 
-// reloadClients sends a reload message to all connected clients
-func (hr *HotReload) reloadClients() {
+// watchPath returns name relative to basedir with forward slashes, the form globs are matched against
+func watchPath(basedir, name string) string {
+	rel, err := filepath.Rel(basedir, name)
+	if err != nil {
+		rel = name
+	}
+	return filepath.ToSlash(rel)
+}
+
+// rebuild rebuilds the frontend after changed and tells the clients how to apply the change.
+// A new client entry is hot swapped, a new stylesheet alone is swapped in place
+// and anything else reloads the page
+func (hr *HotReload) rebuild(changed []string) {
+	var previous pkg.BuildResult
+	if current := hr.engine.frontend.Load(); current != nil {
+		previous = current.client
+	}
+	hr.engine.buildFrontend(changed)
+	current := hr.engine.frontend.Load()
+	if current.err != nil {
+		hr.broadcast(hotMessage{Type: hotError, Errors: buildErrors(current.err)})
+		return
+	}
+
+	message := hotMessage{Type: hotReload}
+	switch {
+	case current.client.JSPath != previous.JSPath:
+		message = hotMessage{Type: hotUpdate, Path: current.client.JSPath}
+	case current.client.CSSPath != previous.CSSPath:
+		message = hotMessage{Type: hotCSS, Path: current.client.CSSPath}
+	}
+	hr.broadcast(message)
+}
+
+// broadcast sends a message to all connected clients
+func (hr *HotReload) broadcast(message hotMessage) {
+	hr.mu.Lock()
+	routeIDs := make([]string, 0, len(hr.connectedClients))
+	for routeID := range hr.connectedClients {
+		routeIDs = append(routeIDs, routeID)
+	}
+	hr.mu.Unlock()
+
+	for _, routeID := range routeIDs {
+		hr.send(routeID, message)
+	}
+}
+
+// send sends a message to the clients connected from the page at routeID
+func (hr *HotReload) send(routeID string, message hotMessage) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		hr.logger.Err(err).Msg("Failed to encode hot reload message")
+		return
+	}
+
 	hr.mu.Lock()
 	defer hr.mu.Unlock()
 
-	for routeID, clients := range hr.connectedClients {
-		for i := len(clients) - 1; i >= 0; i-- {
-			err := clients[i].WriteMessage(websocket.TextMessage, []byte("reload"))
-			if err != nil {
-				hr.logger.Err(err).Str("routeID", routeID).Msg("Error sending reload message, removing client")
-				hr.removeClient(routeID, clients[i])
-			}
+	clients := hr.connectedClients[routeID]
+	for i := len(clients) - 1; i >= 0; i-- {
+		err := clients[i].WriteMessage(websocket.TextMessage, data)
+		if err != nil {
+			hr.logger.Err(err).Str("routeID", routeID).Msg("Error sending hot reload message, removing client")
+			hr.removeClient(routeID, clients[i])
 		}
 	}
 }
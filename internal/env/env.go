@@ -0,0 +1,15 @@
+// Package env holds what the luna CLI and the apps it runs agree on, it imports nothing
+// so the CLI can share it without building the framework
+package env
+
+// DevAddr is set by `luna dev` to the address the app listens on behind its proxy
+const DevAddr = "LUNA_DEV_ADDR"
+
+// Build is set by `luna build` to the directory the app writes its bundles to instead of serving
+const Build = "LUNA_BUILD"
+
+// Export is set by `luna export` to the directory the app exports the site to instead of serving
+const Export = "LUNA_EXPORT"
+
+// HotReloadPath is where the hot reload websocket is mounted unless Config.HotReloadPath says otherwise
+const HotReloadPath = "/_luna/ws"
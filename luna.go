@@ -1,19 +1,27 @@
 package luna
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
+	"io/fs"
 	"net/http"
 	"os"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/Djancyp/luna/internal/env"
 	"github.com/Djancyp/luna/pkg"
 	"github.com/Djancyp/luna/utils"
-	esbuildapi "github.com/evanw/esbuild/pkg/api"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog"
@@ -29,11 +37,23 @@ type NavigateRequest struct {
 
 func New(config Config) (*Engine, error) {
 	server := echo.New()
-	server.Static("/assets", config.AssetsPath)
+	if config.FS != nil {
+		assetsFS, err := dirFS(config, config.AssetsPath)
+		if err != nil {
+			return nil, err
+		}
+		server.StaticFS("/assets", assetsFS)
+	} else {
+		server.Static("/assets", config.AssetsPath)
+	}
 	// make static public
 	server.Use(middleware.CORS())
 	server.Use(middleware.GzipWithConfig(middleware.GzipConfig{
 		Level: 5,
+		// The hot reload websocket takes over the connection
+		Skipper: func(c echo.Context) bool {
+			return config.ENV != "production" && c.Path() == hotReloadPath(config)
+		},
 	}))
 	server.POST("/navigate", func(c echo.Context) error {
 		// check middleware
@@ -78,9 +98,14 @@ func New(config Config) (*Engine, error) {
 		Logger: zerolog.New(os.Stdout).With().Timestamp().Logger(),
 		Server: server,
 		Config: config,
+		assets: pkg.NewStaticAssets(),
+		// bounded like an unconfigured page cache, only the Body of an entry is kept
+		lastGood: pkg.NewMemoryStore(pkg.DefaultCacheMaxEntries, 0),
 	}
+	server.GET(pkg.AssetsPrefix+"*", app.assets.Handler)
 	if config.ENV != "production" {
 		app.HotReload = newHotReload(app)
+		server.GET(hotReloadPath(config), app.HotReload.serveWebsocket)
 		app.HotReload.Start(config.RootPath)
 	}
 	app.CheckApp(config)
@@ -95,7 +120,9 @@ func (e *Engine) CheckApp(config Config) error {
 	checkExistence := func(path string, isFolder bool, errMsg string) {
 		defer wg.Done()
 		var err error
-		if isFolder {
+		if config.FS != nil {
+			_, err = fs.Stat(config.FS, fsPath(path))
+		} else if isFolder {
 			err = utils.IsFolderExist(path)
 		} else {
 			err = utils.IsFileExist(path)
@@ -110,14 +137,19 @@ func (e *Engine) CheckApp(config Config) error {
 	wg.Add(1)
 	go checkExistence(config.AssetsPath, true, "Assets folder not found: %s")
 
-	// Check server and client entry points
-	wg.Add(1)
-	go checkExistence(config.ServerEntryPoint, false, "EntryPoint file not found: %s")
-	wg.Add(1)
-	go checkExistence(config.ClientEntryPoint, false, "EntryPoint file not found: %s")
+	// Check server and client entry points, or the build that replaces them
+	if config.BuildPath != "" {
+		wg.Add(1)
+		go checkExistence(filepath.Join(config.BuildPath, pkg.ManifestFile), false, "Build manifest not found: %s")
+	} else {
+		wg.Add(1)
+		go checkExistence(config.ServerEntryPoint, false, "EntryPoint file not found: %s")
+		wg.Add(1)
+		go checkExistence(config.ClientEntryPoint, false, "EntryPoint file not found: %s")
+	}
 
-	// Check TailwindCSS file if required
-	if config.TailwindCSS {
+	// Check TailwindCSS file if required, a build already contains the Tailwind output
+	if config.TailwindCSS && config.BuildPath == "" {
 		wg.Add(1)
 		go checkExistence(config.RootPath+"tailwind.config.js", false, "TailwindCSS file not found: %s")
 	}
@@ -155,51 +187,35 @@ func (e *Engine) CheckApp(config Config) error {
 }
 
 func (e *Engine) InitializeFrontend() error {
-	// Initialize Tailwind if configured
-	var tailwindCSS string
-	if e.Config.TailwindCSS {
-		tailwindCSS = pkg.Tailwind(e.Config.RootPath)
+	// `luna build` only needs Start to write the bundles
+	if os.Getenv(BuildEnv) != "" {
+		return nil
 	}
-
-	job := pkg.JobRunner{
-		ServerEntryPoint: e.Config.ServerEntryPoint,
-		ClientEntryPoint: e.Config.ClientEntryPoint,
-		Env:              e.Config.ENV,
-	}
-	manager := pkg.NewManager()
-
-	var client, server pkg.BuildResult
-	var buildClientErr, buildServerErr error
-	g, _ := errgroup.WithContext(context.Background())
-
-	if client.JS == "" || server.JS == "" {
-		g.Go(func() error {
-			client, buildClientErr = job.BuildClient()
-			return buildClientErr
-		})
-
-		g.Go(func() error {
-			server, buildServerErr = job.BuildServer()
-			// create a file for server
-			return buildServerErr
-		})
-
-		// Wait for both functions to complete
-		if err := g.Wait(); err != nil {
-			if buildClientErr != nil {
-				e.Logger.Error().Msgf("Error building client: %s", buildClientErr)
-			}
-			if buildServerErr != nil {
-				e.Logger.Error().Msgf("Error building server: %s", buildServerErr)
-			}
-		}
+	e.buildFrontend(nil)
+
+	// The page route reads the current frontend on every request, register it once
+	e.buildMu.Lock()
+	routed := e.routed
+	e.routed = true
+	e.buildMu.Unlock()
+	if routed {
+		return nil
 	}
 
 	e.GET("/*", func(c echo.Context) error {
 		path := c.Request().URL.Path
+		current := e.frontend.Load()
+		client, manager := current.client, current.cache
 
 		// Serve static files directly
 		if filepath.Ext(path) != "" {
+			if e.Config.FS != nil {
+				publicFS, err := dirFS(e.Config, e.Config.PublicPath)
+				if err != nil {
+					return err
+				}
+				return echo.StaticFileHandler(strings.TrimPrefix(path, "/"), publicFS)(c)
+			}
 			return c.File(filepath.Join(e.Config.PublicPath, path))
 		}
 		var store map[string]interface{}
@@ -207,11 +223,10 @@ func (e *Engine) InitializeFrontend() error {
 		if e.Config.Store != nil {
 			store = e.Config.Store(c)
 		}
-		baseURL := c.Request().Host
-		// clean base url if has port
-		baseURL = strings.Split(baseURL, ":")[0]
-		protocol := "ws"
-		swUrl := fmt.Sprintf("%s://%s:%d/ws", protocol, baseURL, e.Config.HotReloadServerPort)
+		var swUrl string
+		if e.HotReload != nil {
+			swUrl = e.HotReload.url(c)
+		}
 
 		// add main css or js
 		// convert aattributes to html
@@ -228,6 +243,34 @@ func (e *Engine) InitializeFrontend() error {
 			}
 			// check where does request come from
 			handler := func(c echo.Context) error {
+				// Cached pages are served as rendered, a stale one is rendered again in the background.
+				// A per-request store would leak into the cached page, such routes have to opt in
+				shared := e.Config.Store == nil || route.CacheVary.SharedStore
+				cacheable := !route.Stream && route.Cacheable() && !e.devPage(c) && shared
+				var cacheKey string
+				var expired *pkg.Cache // served instead of a failed render within its StaleIfError window
+				if cacheable {
+					// IDs start with the build, pages of other builds in a shared store are never served
+					if id, ok := c.Request().Context().Value(revalidateKey{}).(string); ok && strings.HasPrefix(id, current.build) {
+						cacheKey = id
+					} else {
+						cacheKey = current.build + route.CacheVary.CacheKey(c, path)
+						if cached, found := manager.GetCache(cacheKey); found {
+							now := time.Now()
+							if !cached.Expired(now) {
+								if cached.Stale(now) {
+									// the request carries the same varied headers, stored entries lack the credentials
+									_, header := route.CacheVary.Vary(c.Request())
+									e.revalidate(cached, header)
+								}
+								setCacheHeaders(c, route, cached.RenderedAt)
+								return c.HTMLBlob(http.StatusOK, cached.Page)
+							}
+							expired = &cached
+						}
+					}
+				}
+
 				_, params := pkg.MatchPath(route.Path, path)
 				var props map[string]interface{}
 				if route.Props != nil {
@@ -239,50 +282,13 @@ func (e *Engine) InitializeFrontend() error {
 				if store == nil {
 					store = map[string]interface{}{}
 				}
-				jsonProps, error := json.Marshal(props)
-				if error != nil {
-					return error
-				}
-				jsonStore, error := json.Marshal(store)
-				if error != nil {
-					return error
-				}
-				cjs := esbuildapi.Transform(client.JS, esbuildapi.TransformOptions{
-					Define: map[string]string{
-						"props":  string(jsonProps),
-						"store":  string(jsonStore),
-						"global": "globalThis",
-					},
+				// props and store are handed to the client as JSON, the bundle itself never changes
+				data, err := json.Marshal(map[string]interface{}{
+					"props": props,
+					"store": store,
 				})
-				sjs := esbuildapi.Transform(server.JS, esbuildapi.TransformOptions{
-					Define: map[string]string{
-						"props":  string(jsonProps),
-						"store":  string(jsonStore),
-						"global": "globalThis",
-					},
-				})
-				server.CSS = fmt.Sprintf("%s\n%s", server.CSS, tailwindCSS)
-
-				serverHTML, err := pkg.RenderServer(string(sjs.Code), route.Path)
 				if err != nil {
-					e.Logger.Error().Msgf("Error rendering server HTML: %s", err)
-					return c.String(http.StatusInternalServerError, "Error rendering server HTML")
-				}
-
-				if cachedItem, found := manager.GetCache(path); found {
-					// Check for cached page if in production mode
-					return cachedItem.HTML.Execute(c.Response().Writer, pkg.CreateTemplateData{
-						Title:           cachedItem.Title,
-						Description:     cachedItem.Description,
-						Favicon:         cachedItem.Favicon,
-						CssLinks:        cachedItem.CSSLinks,
-						RenderedContent: template.HTML(serverHTML),
-						JS:              template.JS(string(cjs.Code)),
-						CSS:             template.CSS(cachedItem.CSS),
-						Dev:             e.Config.ENV != "production",
-						SWUrl:           swUrl,
-						MainHead:        attributes,
-					})
+					return err
 				}
 				// Collect CSS and JS links
 				cssLinks := make([]template.HTML, len(route.Head.CssLinks))
@@ -294,6 +300,10 @@ func (e *Engine) InitializeFrontend() error {
 						cssLinks[i] = template.HTML(fmt.Sprintf("<link href=\"/assets/%s\" rel=\"stylesheet\" />", css.Href))
 					}
 				}
+				preloads, routeStyles := client.RouteAssets(route.Component)
+				for _, href := range routeStyles {
+					cssLinks = append(cssLinks, template.HTML(fmt.Sprintf("<link href=\"%s\" rel=\"stylesheet\" />", href)))
+				}
 				jsLinks := make([]template.HTML, len(route.Head.JsLinks))
 				for i, js := range route.Head.JsLinks {
 					jsLinks[i] = template.HTML(fmt.Sprintf("<script src=\"/assets/%s\" type=\"module\"></script>", js.Src))
@@ -306,37 +316,100 @@ func (e *Engine) InitializeFrontend() error {
 					return c.String(http.StatusInternalServerError, "Error loading template")
 				}
 
-				cacheData := pkg.Cache{
-					ID:          path,
+				// Render response with template data
+				templateData := pkg.CreateTemplateData{
 					Title:       route.Head.Title,
 					Description: route.Head.Description,
 					Favicon:     e.Config.FaviconPath,
-					Path:        path,
-					HTML:        htmlTemplate,
-					Body:        serverHTML,
-					CSS:         server.CSS,
-					JS:          string(cjs.Code),
-					CSSLinks:    cssLinks,
-					Expiration:  route.CacheExpiry,
+					CssLinks:    cssLinks,
+					JsLinks:     jsLinks,
+					JSPath:      client.JSPath,
+					Preloads:    preloads,
+					Data:        template.JS(data),
+					CSSPath:     client.CSSPath,
+					Dev:         e.devPage(c),
+					SWUrl:       swUrl,
+					MainHead:    attributes,
 				}
-				manager.AddCache(cacheData)
 
-				// Render response with template data
-				templateData := pkg.CreateTemplateData{
-					Title:           route.Head.Title,
-					Description:     route.Head.Description,
-					Favicon:         e.Config.FaviconPath,
-					CssLinks:        cssLinks,
-					JsLinks:         jsLinks,
-					RenderedContent: template.HTML(serverHTML),
-					JS:              template.JS(cjs.Code),
-					CSS:             template.CSS(server.CSS),
-					Dev:             false,
-					SWUrl:           swUrl,
-					MainHead:        attributes,
+				renderRequest := pkg.RenderRequest{
+					Path:   route.Path,
+					Props:  props,
+					Store:  store,
+					Limits: e.Config.RenderLimits.Merge(route.RenderLimits),
+				}
+				if route.Stream {
+					return e.streamPage(c, htmlTemplate, templateData, renderRequest)
+				}
+
+				// Last good renders are kept per variant under the rule of the page cache
+				var lastGoodKey string
+				if route.SSRFallback == pkg.SSRFallbackLastGood && shared {
+					lastGoodKey = route.CacheVary.CacheKey(c, path)
 				}
 
-				return htmlTemplate.Execute(c.Response().Writer, templateData)
+				serverHTML, err := e.renderer.Render(c.Request().Context(), renderRequest)
+				fallback := err != nil
+				if err != nil && expired != nil {
+					e.Logger.Error().Err(err).Str("path", path).Msg("Error rendering server HTML, serving the expired page")
+					setCacheHeaders(c, route, expired.RenderedAt)
+					return c.HTMLBlob(http.StatusOK, expired.Page)
+				}
+				if err != nil {
+					serverHTML, err = e.ssrFallback(route, path, lastGoodKey, err)
+					if err != nil {
+						e.Logger.Error().Err(err).Msg("Error rendering server HTML")
+						// In development the error is shown in the browser overlay
+						if e.HotReload != nil {
+							return e.HotReload.errorPage(c, htmlTemplate, templateData, path, err)
+						}
+						// Render errors go through Echo's error handler like any other handler error
+						return err
+					}
+					templateData.ClientOnly = serverHTML == ""
+				} else if lastGoodKey != "" {
+					e.lastGood.Set(pkg.Cache{ID: lastGoodKey, Path: path, Body: serverHTML})
+				}
+
+				templateData.RenderedContent = template.HTML(serverHTML)
+				var page bytes.Buffer
+				if err := htmlTemplate.Execute(&page, templateData); err != nil {
+					return err
+				}
+				// Fallback pages are not cached so the next request renders again
+				renderedAt := time.Now()
+				if cacheable && !fallback {
+					staleAt, expires, staleIfError := route.CacheLifetime(renderedAt)
+					query, header := route.CacheVary.Vary(c.Request())
+					// the escaped path, a decoded one cannot be requested again
+					url := c.Request().URL.EscapedPath()
+					if len(query) > 0 {
+						url += "?" + query.Encode()
+					}
+					manager.AddCache(pkg.Cache{
+						ID:           cacheKey,
+						Title:        route.Head.Title,
+						Description:  route.Head.Description,
+						Favicon:      e.Config.FaviconPath,
+						Path:         path,
+						URL:          url,
+						Header:       header,
+						HTML:         htmlTemplate,
+						Body:         serverHTML,
+						CSSPath:      client.CSSPath,
+						JSPath:       client.JSPath,
+						CSSLinks:     cssLinks,
+						Preloads:     preloads,
+						Page:         page.Bytes(),
+						Tags:         append(slices.Clip(route.CacheTags), pkg.CacheTags(c)...),
+						RenderedAt:   renderedAt,
+						StaleAt:      staleAt,
+						Expires:      expires,
+						StaleIfError: staleIfError,
+					})
+					setCacheHeaders(c, route, renderedAt)
+				}
+				return c.HTMLBlob(http.StatusOK, page.Bytes())
 			}
 
 			if route.Middleware != nil {
@@ -356,6 +429,142 @@ func (e *Engine) InitializeFrontend() error {
 	return nil
 }
 
+// buildFrontend builds the client and server bundles and swaps them in for new requests.
+// A failed build keeps serving the previous bundle
+func (e *Engine) buildFrontend(changed []string) {
+	// The watcher and InitializeFrontend may build at the same time
+	e.buildMu.Lock()
+	defer e.buildMu.Unlock()
+	if e.bundler == nil {
+		e.bundler = e.newBundler()
+	}
+
+	var client, server pkg.BuildResult
+	var buildClientErr, buildServerErr error
+	g, _ := errgroup.WithContext(context.Background())
+
+	// A prebuilt stylesheet already contains the Tailwind output
+	if e.Config.TailwindCSS && e.Config.BuildPath == "" && (e.tailwindCSS == "" || tailwindChanged(changed)) {
+		g.Go(func() error {
+			e.tailwindCSS = pkg.Tailwind(e.Config.RootPath)
+			return nil
+		})
+	}
+
+	g.Go(func() error {
+		client, buildClientErr = e.bundler.BuildClient()
+		return buildClientErr
+	})
+
+	g.Go(func() error {
+		server, buildServerErr = e.bundler.BuildServer()
+		return buildServerErr
+	})
+
+	// Wait for both functions to complete
+	if err := g.Wait(); err != nil {
+		if buildClientErr != nil {
+			e.Logger.Error().Msgf("Error building client: %s", buildClientErr)
+		}
+		if buildServerErr != nil {
+			e.Logger.Error().Msgf("Error building server: %s", buildServerErr)
+		}
+	}
+
+	previous := e.frontend.Load()
+	cacheOptions := e.Config.PageCache
+	if cacheOptions.OnError == nil {
+		cacheOptions.OnError = func(err error) {
+			e.Logger.Error().Err(err).Msg("Page cache error")
+		}
+	}
+	next := &frontend{cache: pkg.NewManager(cacheOptions), err: errors.Join(buildClientErr, buildServerErr)}
+
+	// Keep the pool warm with the latest server bundle
+	if buildServerErr == nil {
+		sourceMap, err := pkg.ParseSourceMap(server.SourceMap)
+		if err != nil {
+			e.Logger.Warn().Err(err).Msg("Server source map unavailable, render errors point into the bundle")
+		}
+		if e.renderer == nil {
+			e.renderer = pkg.NewRuntimePool(server.JS, sourceMap, e.Config.RenderPoolSize)
+		} else {
+			e.renderer.Reload(server.JS, sourceMap)
+		}
+		next.sourceMap = sourceMap
+	} else if previous != nil {
+		next.sourceMap = previous.sourceMap
+	} else if e.renderer == nil {
+		// Without a bundle yet every render fails with a RenderError until a build succeeds
+		e.renderer = pkg.NewRuntimePool("", nil, e.Config.RenderPoolSize)
+	}
+
+	// Swap the client output and the page cache in one step. Cached pages embed the
+	// client URLs, so a new build misses the pages a persistent store kept from older ones
+	if buildClientErr == nil {
+		client.AppendCSS(e.tailwindCSS)
+		e.assets.Set(client.Files)
+		next.client = client
+	} else if previous != nil {
+		next.client = previous.client
+	}
+	next.build = buildID(next.client)
+	e.frontend.Store(next)
+	if previous != nil {
+		previous.cache.Close()
+	}
+}
+
+// tailwindExtensions are the files Tailwind scans for class names, its config and stylesheets included
+var tailwindExtensions = []string{".html", ".js", ".jsx", ".mjs", ".cjs", ".ts", ".tsx", ".mdx", ".css"}
+
+// tailwindChanged reports whether Tailwind has to run again after changed, nil means anything changed
+func tailwindChanged(changed []string) bool {
+	if changed == nil {
+		return true
+	}
+	return slices.ContainsFunc(changed, func(name string) bool {
+		return slices.Contains(tailwindExtensions, filepath.Ext(name))
+	})
+}
+
+// buildID hashes the names of the hashed client files, it changes whenever a URL a page embeds does
+func buildID(client pkg.BuildResult) string {
+	names := make([]string, 0, len(client.Files))
+	for name := range client.Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	sum := sha256.Sum256([]byte(strings.Join(names, "\n")))
+	return hex.EncodeToString(sum[:6]) + ":"
+}
+
+// newBundler loads the bundles from Config.BuildPath when set
+// and reuses esbuild contexts between builds outside production
+func (e *Engine) newBundler() pkg.Bundler {
+	if e.Config.BuildPath != "" {
+		buildFS, err := dirFS(e.Config, e.Config.BuildPath)
+		if err != nil {
+			e.Logger.Error().Err(err).Msg("Invalid BuildPath")
+		}
+		return pkg.Prebuilt{FS: buildFS}
+	}
+	job := pkg.JobRunner{
+		ServerEntryPoint: e.Config.ServerEntryPoint,
+		ClientEntryPoint: e.Config.ClientEntryPoint,
+		Env:              e.Config.ENV,
+	}
+	if e.Config.ENV == "production" {
+		return job
+	}
+	builder, err := pkg.NewBuilder(job)
+	if err != nil {
+		e.Logger.Warn().Err(err).Msg("Incremental builds unavailable, rebuilding from scratch")
+		return job
+	}
+	return builder
+}
+
 func (e *Engine) GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route {
 	return e.Server.Add(http.MethodGet, path, h, m...)
 }
@@ -376,7 +585,40 @@ func (e *Engine) PATCH(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc
 	return e.Server.Add(http.MethodPatch, path, h, m...)
 }
 
+// DevAddrEnv is set by `luna dev`, which runs the app behind its own proxy on this address
+const DevAddrEnv = env.DevAddr
+
+// BuildEnv is set by `luna build` to the directory Start writes the bundles to instead of serving
+const BuildEnv = env.Build
+
+// Build writes production bundles and their manifest to dir, load them with Config.BuildPath
+func (e *Engine) Build(dir string) error {
+	return pkg.Build(dir, pkg.BuildOptions{
+		ServerEntryPoint: e.Config.ServerEntryPoint,
+		ClientEntryPoint: e.Config.ClientEntryPoint,
+		TailwindCSS:      e.Config.TailwindCSS,
+		RootPath:         e.Config.RootPath,
+	})
+}
+
 func (e *Engine) Start(address string) {
+	if dir := os.Getenv(BuildEnv); dir != "" {
+		if err := e.Build(dir); err != nil {
+			e.Logger.Fatal().Err(err).Msg("Build failed")
+		}
+		e.Logger.Info().Msgf("Build written to %s", dir)
+		return
+	}
+	if dir := os.Getenv(ExportEnv); dir != "" {
+		if err := e.Export(dir); err != nil {
+			e.Logger.Fatal().Err(err).Msg("Export failed")
+		}
+		e.Logger.Info().Msgf("Site exported to %s", dir)
+		return
+	}
+	if addr := os.Getenv(DevAddrEnv); addr != "" {
+		address = addr
+	}
 	e.Server.Logger.Fatal(e.Server.Start(address))
 }
 
@@ -0,0 +1,103 @@
+package luna
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"os"
+
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+// overlayError is a build or render error shown by the dev overlay
+type overlayError struct {
+	Kind    string `json:"kind"` // "build" or "render"
+	Message string `json:"message"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Column  int    `json:"column,omitempty"`
+	Frame   string `json:"frame,omitempty"` // source lines around the error
+	Stack   string `json:"stack,omitempty"`
+}
+
+// buildErrors converts the errors of a failed build, client and server
+// usually report the same diagnostic so duplicates are dropped
+func buildErrors(err error) []overlayError {
+	errs := []error{err}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joined.Unwrap()
+	}
+
+	var overlay []overlayError
+	seen := make(map[overlayError]bool)
+	for _, err := range errs {
+		var buildErr *pkg.BuildError
+		if !errors.As(err, &buildErr) {
+			overlay = append(overlay, overlayError{Kind: "build", Message: err.Error()})
+			continue
+		}
+		for _, m := range buildErr.Messages {
+			item := overlayError{Kind: "build", Message: m.Text, File: m.File, Line: m.Line, Column: m.Column}
+			if seen[item] {
+				continue
+			}
+			seen[item] = true
+			if source, err := os.ReadFile(m.File); err == nil {
+				item.Frame = pkg.CodeFrame(string(source), m.Line, m.Column)
+			} else if m.LineText != "" {
+				item.Frame = pkg.CodeFrame(m.LineText, 1, m.Column)
+			}
+			overlay = append(overlay, item)
+		}
+	}
+	return overlay
+}
+
+// renderErrors converts a server render error, with a code frame from the
+// original sources embedded in the server source map
+func (hr *HotReload) renderErrors(err error) []overlayError {
+	item := overlayError{Kind: "render", Message: err.Error()}
+	var renderErr *pkg.RenderError
+	if errors.As(err, &renderErr) {
+		item.Message = renderErr.Message
+		if renderErr.Name != "" {
+			item.Message = renderErr.Name + ": " + item.Message
+		}
+		item.File, item.Line, item.Column = renderErr.File, renderErr.Line, renderErr.Column
+		item.Stack = renderErr.Stack
+		if current := hr.engine.frontend.Load(); current != nil {
+			if source := current.sourceMap.SourceContent(renderErr.File); source != "" {
+				// no caret without a known column
+				column := renderErr.Column
+				if column == 0 {
+					column = -1
+				}
+				item.Frame = pkg.CodeFrame(source, renderErr.Line, column)
+			}
+		}
+	}
+	return []overlayError{item}
+}
+
+// errorPage answers a failed render with the page shell and the error in the overlay.
+// The client bundle is left out, the page reloads once the next build succeeds
+func (hr *HotReload) errorPage(c echo.Context, tmpl *template.Template, data pkg.CreateTemplateData, path string, err error) error {
+	overlay := hr.renderErrors(err)
+	hr.send(path, hotMessage{Type: hotError, Errors: overlay})
+
+	encoded, jsonErr := json.Marshal(overlay)
+	if jsonErr != nil {
+		return err
+	}
+	data.DevErrors = template.JS(encoded)
+	data.ClientOnly = true
+	data.JSPath = ""
+	data.Preloads = nil
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	res.WriteHeader(http.StatusInternalServerError)
+	return tmpl.Execute(res, data)
+}
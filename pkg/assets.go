@@ -0,0 +1,66 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// AssetsPrefix is the URL prefix the hashed client output is served from
+const AssetsPrefix = "/_luna/"
+
+// StaticAssets holds the in-memory client build output served under AssetsPrefix
+type StaticAssets struct {
+	mu    sync.RWMutex
+	files map[string][]byte
+}
+
+// NewStaticAssets initializes an empty StaticAssets instance
+func NewStaticAssets() *StaticAssets {
+	return &StaticAssets{
+		files: make(map[string][]byte),
+	}
+}
+
+// Set replaces the served files, keyed by their name relative to AssetsPrefix
+func (a *StaticAssets) Set(files map[string][]byte) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.files = files
+}
+
+// Get returns the contents of a file by its name relative to AssetsPrefix
+func (a *StaticAssets) Get(name string) ([]byte, bool) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	content, ok := a.files[name]
+	return content, ok
+}
+
+// Handler serves the files with immutable cache headers, file names change with their content
+func (a *StaticAssets) Handler(c echo.Context) error {
+	name := strings.TrimPrefix(c.Request().URL.Path, AssetsPrefix)
+	content, ok := a.Get(name)
+	if !ok {
+		return echo.ErrNotFound
+	}
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = echo.MIMEOctetStream
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, "public, max-age=31536000, immutable")
+	return c.Blob(200, contentType, content)
+}
+
+// HashName returns a content hashed file name such as client.1a2b3c4d.css
+func HashName(name, ext string, content []byte) string {
+	sum := sha256.Sum256(content)
+	return name + "." + strings.ToUpper(hex.EncodeToString(sum[:4])) + ext
+}
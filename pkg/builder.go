@@ -0,0 +1,47 @@
+package pkg
+
+import esbuild "github.com/evanw/esbuild/pkg/api"
+
+// Bundler builds the client and server bundles
+type Bundler interface {
+	BuildClient() (BuildResult, error)
+	BuildServer() (BuildResult, error)
+}
+
+// Builder keeps long-lived esbuild contexts so every build after the first
+// only reprocesses the files that changed. It is meant for development
+type Builder struct {
+	job    JobRunner
+	client esbuild.BuildContext
+	server esbuild.BuildContext
+}
+
+// NewBuilder creates the esbuild contexts for the client and server entry points of job
+func NewBuilder(job JobRunner) (*Builder, error) {
+	client, ctxErr := esbuild.Context(job.clientOptions())
+	if ctxErr != nil {
+		return nil, newBuildError(ctxErr.Errors)
+	}
+	server, ctxErr := esbuild.Context(job.serverOptions())
+	if ctxErr != nil {
+		client.Dispose()
+		return nil, newBuildError(ctxErr.Errors)
+	}
+	return &Builder{job: job, client: client, server: server}, nil
+}
+
+// BuildClient incrementally rebuilds the client bundle
+func (b *Builder) BuildClient() (BuildResult, error) {
+	return b.job.clientResult(b.client.Rebuild())
+}
+
+// BuildServer incrementally rebuilds the server bundle
+func (b *Builder) BuildServer() (BuildResult, error) {
+	return b.job.serverResult(b.server.Rebuild())
+}
+
+// Dispose releases the esbuild contexts, the Builder must not be used afterwards
+func (b *Builder) Dispose() {
+	b.client.Dispose()
+	b.server.Dispose()
+}
@@ -1,74 +1,314 @@
 package pkg
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"html/template"
+	"net/http"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// DefaultCacheSweepInterval is how often a Manager removes expired pages unless CacheOptions say otherwise
+const DefaultCacheSweepInterval = time.Minute
+
+// CacheOptions configures the page cache. MaxEntries and MaxBytes bound the default
+// MemoryStore, see NewMemoryStore, a custom Store brings its own bounds
+type CacheOptions struct {
+	MaxEntries    int             // number of cached pages
+	MaxBytes      int64           // total size of the cached pages, a larger page is not cached
+	SweepInterval time.Duration   // how often expired pages are removed from a store that is a CacheSweeper, negative disables the sweeper
+	Store         CacheStore      // where pages are kept, a MemoryStore of this process by default
+	Bus           CacheBus        // fans invalidations out to the other replicas
+	OnError       func(err error) // called with the errors of the store and the bus, which never fail a request
+}
+
+// CacheStore keeps the cached pages. A store may be shared between replicas, such as a RedisStore
+type CacheStore interface {
+	Get(id string) (Cache, bool, error) // an entry that can no longer be served is reported as missing
+	Set(cache Cache) error              // replaces the entry with the same ID
+	Delete(match func(Cache) bool) (int, error)
+	Entries() ([]Cache, error)  // Body and Page may be left out
+	Stats() (CacheStats, error) // hits and misses are counted by the Manager
+	Close() error
+}
+
+// CacheSweeper is implemented by stores that rely on the Manager to remove expired pages
+type CacheSweeper interface {
+	DeleteExpired() error
+}
+
+// CacheBus carries invalidations between the Managers of several replicas
+type CacheBus interface {
+	Publish(invalidation Invalidation) error
+	// Subscribe calls handle with every published invalidation until stop is called
+	Subscribe(handle func(Invalidation)) (stop func(), err error)
+}
+
+// Invalidation selects cached pages to drop by path, route pattern, tag or all of them
+type Invalidation struct {
+	Paths  []string `json:"paths,omitempty"`
+	Routes []string `json:"routes,omitempty"` // route patterns such as "/decks/:id"
+	Tags   []string `json:"tags,omitempty"`
+	All    bool     `json:"all,omitempty"`
+	Origin string   `json:"origin,omitempty"` // Manager that published it, which ignores it coming back
+}
+
+// Match reports whether the invalidation drops cache
+func (i Invalidation) Match(cache Cache) bool {
+	if i.All || slices.Contains(i.Paths, cache.Path) {
+		return true
+	}
+	for _, pattern := range i.Routes {
+		if matched, _ := MatchPath(pattern, cache.Path); matched || pattern == cache.Path {
+			return true
+		}
+	}
+	return slices.ContainsFunc(cache.Tags, func(tag string) bool { return slices.Contains(i.Tags, tag) })
+}
+
+// Manager is the page cache of a frontend, it keeps pages in a CacheStore keyed by Cache.ID
 type Manager struct {
-	Cache []Cache
-	mu    sync.RWMutex
+	options     CacheOptions
+	store       CacheStore
+	id          string // origin of the invalidations this Manager publishes
+	hits        atomic.Int64
+	misses      atomic.Int64
+	stop        chan struct{}
+	closed      sync.Once
+	unsubscribe func()
+}
+
+// CacheStats describes the page cache
+type CacheStats struct {
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"` // entries dropped to stay within CacheOptions
+}
+
+// CacheEntry describes a cached page without its content
+type CacheEntry struct {
+	ID         string     `json:"id"`
+	Path       string     `json:"path"`
+	Tags       []string   `json:"tags,omitempty"`
+	Bytes      int64      `json:"bytes"`
+	RenderedAt time.Time  `json:"renderedAt"`
+	StaleAt    *time.Time `json:"staleAt,omitempty"` // nil when the page never goes stale
+	Expires    *time.Time `json:"expires,omitempty"` // nil when the page never expires
 }
 
 type Cache struct {
-	ID          string
-	Title       string
-	Favicon     string
-	Description string
-	Path        string
-	HTML        *template.Template
-	Body        string
-	CSS         string
-	JS          string
-	CSSLinks    []template.HTML
-	Expiration  int64 // Unix timestamp for expiration
+	ID                 string // cache key, the path and a hash of what the page varies on
+	Title              string
+	Favicon            string
+	Description        string
+	Path               string
+	URL                string             // escaped path and varied query the page was rendered for
+	Header             http.Header        // varied request headers the page was rendered with, credentials are not stored
+	CredentialsDropped bool               // Header lost its Cookie or Authorization when the entry was stored
+	HTML               *template.Template `json:"-"`
+	Body               string
+	CSSPath            string
+	JSPath             string
+	CSSLinks           []template.HTML
+	Preloads           []string
+	Page               []byte        // the rendered document, served as is on a hit
+	Tags               []string      // tags the page is revalidated by
+	RenderedAt         time.Time     // when Page was rendered
+	StaleAt            time.Time     // when Page is rendered again in the background, zero never
+	Expires            time.Time     // when Page is no longer served, zero never
+	StaleIfError       time.Duration // how long after Expires Page is still served when rendering it again fails
+	bytes              int64         // size of the entry when a store left Body and Page out
 }
 
-// NewManager initializes a new Manager instance
-func NewManager() *Manager {
-	return &Manager{
-		Cache: make([]Cache, 0),
+// credentialHeaders are kept in memory only, stores that marshal entries never receive them
+var credentialHeaders = []string{"Cookie", "Authorization"}
+
+// MarshalJSON leaves the credentials out of Header, replaying the page needs a request that carries them
+func (c Cache) MarshalJSON() ([]byte, error) {
+	type cache Cache
+	stored := cache(c)
+	for _, name := range credentialHeaders {
+		if stored.Header.Get(name) == "" {
+			continue
+		}
+		if !stored.CredentialsDropped {
+			stored.Header = stored.Header.Clone()
+			stored.CredentialsDropped = true
+		}
+		stored.Header.Del(name)
 	}
+	return json.Marshal(stored)
 }
 
-// AddCache adds a new cache entry with a default TTL of 10 minutes
-func (m *Manager) AddCache(cache Cache) {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// Stale reports whether the page is due to be rendered again
+func (c Cache) Stale(now time.Time) bool {
+	return !c.StaleAt.IsZero() && !now.Before(c.StaleAt)
+}
 
-	m.Cache = append(m.Cache, cache)
+// Expired reports whether the page has to be rendered again before it is served.
+// An expired page is kept for StaleIfError to stand in for a failed render
+func (c Cache) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires)
 }
 
-// GetCache retrieves a cache entry by ID if it hasn’t expired
-func (m *Manager) GetCache(path string) (Cache, bool) {
-	m.mu.RLock()
-	defer m.mu.RUnlock()
+// dead reports whether the page can no longer be served at all
+func (c Cache) dead(now time.Time) bool {
+	return !c.Expires.IsZero() && !now.Before(c.Expires.Add(c.StaleIfError))
+}
 
-	for _, cache := range m.Cache {
-		if cache.Path == path && cache.Expiration > time.Now().Unix() {
-			return cache, true
+// Entry describes the page
+func (c Cache) Entry() CacheEntry {
+	entry := CacheEntry{
+		ID:         c.ID,
+		Path:       c.Path,
+		Tags:       c.Tags,
+		Bytes:      c.size(),
+		RenderedAt: c.RenderedAt,
+	}
+	if !c.StaleAt.IsZero() {
+		entry.StaleAt = &c.StaleAt
+	}
+	if !c.Expires.IsZero() {
+		entry.Expires = &c.Expires
+	}
+	return entry
+}
+
+// size approximates the memory the entry holds
+func (c Cache) size() int64 {
+	if c.bytes > 0 {
+		return c.bytes
+	}
+	return int64(len(c.ID) + len(c.Body) + len(c.Page))
+}
+
+// NewManager initializes a new Manager instance, starts its expiry sweeper and subscribes it to the bus.
+// Close stops both
+func NewManager(options CacheOptions) *Manager {
+	if options.SweepInterval == 0 {
+		options.SweepInterval = DefaultCacheSweepInterval
+	}
+	store := options.Store
+	if store == nil {
+		store = NewMemoryStore(options.MaxEntries, options.MaxBytes)
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	m := &Manager{
+		options: options,
+		store:   store,
+		id:      hex.EncodeToString(id),
+		stop:    make(chan struct{}),
+	}
+	if sweeper, ok := store.(CacheSweeper); ok && options.SweepInterval > 0 {
+		go m.sweep(sweeper, options.SweepInterval)
+	}
+	if options.Bus != nil {
+		unsubscribe, err := options.Bus.Subscribe(m.invalidated)
+		m.report(err)
+		m.unsubscribe = unsubscribe
+	}
+	return m
+}
+
+// Close stops the expiry sweeper and the bus subscription. The store stays usable,
+// a store passed in CacheOptions is closed by its owner
+func (m *Manager) Close() {
+	m.closed.Do(func() {
+		close(m.stop)
+		if m.unsubscribe != nil {
+			m.unsubscribe()
+		}
+	})
+}
+
+func (m *Manager) sweep(sweeper CacheSweeper, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.report(sweeper.DeleteExpired())
 		}
 	}
-	return Cache{}, false
 }
 
-// DeleteExpired removes expired entries from the Cache
-func (m *Manager) DeleteExpired() {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+// report hands a store or bus error to OnError
+func (m *Manager) report(err error) {
+	if err != nil && m.options.OnError != nil {
+		m.options.OnError(err)
+	}
+}
+
+// AddCache adds a cache entry, replacing the entry with the same ID
+func (m *Manager) AddCache(cache Cache) {
+	m.report(m.store.Set(cache))
+}
+
+// GetCache retrieves a cache entry by ID, a store error counts as a miss.
+// The entry may have expired but still be within its StaleIfError window
+func (m *Manager) GetCache(id string) (Cache, bool) {
+	cache, found, err := m.store.Get(id)
+	m.report(err)
+	if !found || err != nil {
+		m.misses.Add(1)
+		return Cache{}, false
+	}
+	m.hits.Add(1)
+	return cache, true
+}
 
-	now := time.Now().Unix()
-	m.Cache = filterExpired(m.Cache, now)
+// Stats returns the size of the cache and its counters since the Manager was created
+func (m *Manager) Stats() CacheStats {
+	stats, err := m.store.Stats()
+	m.report(err)
+	stats.Hits = m.hits.Load()
+	stats.Misses = m.misses.Load()
+	return stats
 }
 
-// filterExpired is a helper function that filters out expired cache entries
-func filterExpired(caches []Cache, currentTime int64) []Cache {
-	filtered := make([]Cache, 0)
+// Entries returns the entries match reports true for
+func (m *Manager) Entries(match func(Cache) bool) []Cache {
+	caches, err := m.store.Entries()
+	m.report(err)
+	var entries []Cache
 	for _, cache := range caches {
-		if cache.Expiration > currentTime {
-			filtered = append(filtered, cache)
+		if match(cache) {
+			entries = append(entries, cache)
 		}
 	}
-	return filtered
+	return entries
+}
+
+// Invalidate drops the entries selected by invalidation and publishes it to the other replicas.
+// It returns how many entries it dropped from the store
+func (m *Manager) Invalidate(invalidation Invalidation) int {
+	removed, err := m.store.Delete(invalidation.Match)
+	m.report(err)
+	if m.options.Bus != nil {
+		invalidation.Origin = m.id
+		m.report(m.options.Bus.Publish(invalidation))
+	}
+	return removed
+}
+
+// invalidated applies an invalidation published by another replica.
+// A store that is also the bus is shared, the publishing replica already dropped its entries
+func (m *Manager) invalidated(invalidation Invalidation) {
+	if invalidation.Origin == m.id {
+		return
+	}
+	if bus, ok := m.store.(CacheBus); ok && bus == m.options.Bus {
+		return
+	}
+	_, err := m.store.Delete(invalidation.Match)
+	m.report(err)
 }
@@ -0,0 +1,120 @@
+package pkg
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Chunk is a client output file and the chunks it needs before it can run
+type Chunk struct {
+	EntryPoint string   `json:"entryPoint,omitempty"` // source file the chunk was built from, only set for entry points
+	Imports    []string `json:"imports,omitempty"`    // statically imported chunks, by file name
+	CSS        string   `json:"css,omitempty"`        // stylesheet bundled for this entry point, by file name
+}
+
+type metafile struct {
+	Outputs map[string]struct {
+		EntryPoint string `json:"entryPoint"`
+		CSSBundle  string `json:"cssBundle"`
+		Imports    []struct {
+			Path string `json:"path"`
+			Kind string `json:"kind"`
+		} `json:"imports"`
+	} `json:"outputs"`
+}
+
+// parseChunks reads the chunk graph of a build from the esbuild metafile.
+// Output paths in the metafile are relative to the working directory
+func parseChunks(meta string) (map[string]Chunk, error) {
+	var m metafile
+	if err := json.Unmarshal([]byte(meta), &m); err != nil {
+		return nil, err
+	}
+	chunks := make(map[string]Chunk, len(m.Outputs))
+	for path, output := range m.Outputs {
+		if !strings.HasSuffix(path, ".js") {
+			continue
+		}
+		chunk := Chunk{}
+		if output.EntryPoint != "" {
+			chunk.EntryPoint = sourcePath(output.EntryPoint)
+		}
+		if output.CSSBundle != "" {
+			chunk.CSS = outputName(output.CSSBundle)
+		}
+		for _, imp := range output.Imports {
+			if imp.Kind == "import-statement" {
+				chunk.Imports = append(chunk.Imports, outputName(imp.Path))
+			}
+		}
+		chunks[outputName(path)] = chunk
+	}
+	return chunks, nil
+}
+
+// outputName converts a metafile output path to a file name relative to the output directory
+func outputName(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	return strings.TrimPrefix(filepath.ToSlash(abs), "/")
+}
+
+// sourcePath normalizes a source file path so config paths and metafile entry points compare equal
+func sourcePath(path string) string {
+	if filepath.IsAbs(path) {
+		if wd, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(wd, path); err == nil {
+				path = rel
+			}
+		}
+	}
+	return filepath.ToSlash(filepath.Clean(path))
+}
+
+// RouteAssets returns the public URLs of the chunks and stylesheets a route needs.
+// component is the source file of the route's page, as it is imported by the client entry.
+// The client entry itself and its stylesheet are not included
+func (b BuildResult) RouteAssets(component string) (scripts []string, styles []string) {
+	entry := strings.TrimPrefix(b.JSPath, AssetsPrefix)
+	seen := map[string]bool{entry: true}
+
+	var visit func(name string)
+	visit = func(name string) {
+		for _, imp := range b.Chunks[name].Imports {
+			if seen[imp] {
+				continue
+			}
+			seen[imp] = true
+			scripts = append(scripts, AssetsPrefix+imp)
+			visit(imp)
+		}
+	}
+	visit(entry)
+
+	if component != "" {
+		component = sourcePath(component)
+		names := make([]string, 0, len(b.Chunks))
+		for name := range b.Chunks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			chunk := b.Chunks[name]
+			if chunk.EntryPoint != component || seen[name] {
+				continue
+			}
+			seen[name] = true
+			scripts = append(scripts, AssetsPrefix+name)
+			if chunk.CSS != "" {
+				styles = append(styles, AssetsPrefix+chunk.CSS)
+			}
+			visit(name)
+		}
+	}
+	return scripts, styles
+}
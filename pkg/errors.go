@@ -0,0 +1,158 @@
+package pkg
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/buke/quickjs-go"
+	esbuild "github.com/evanw/esbuild/pkg/api"
+)
+
+// RenderError is returned when the server bundle throws while rendering a page
+type RenderError struct {
+	Path    string // request path that was rendered
+	Name    string // JS error name such as TypeError, empty for thrown non-errors
+	Message string
+	Stack   string
+	File    string // file of the innermost stack frame with a location
+	Line    int
+	Column  int // 0 when unknown, QuickJS frames usually only carry a line
+}
+
+func (e *RenderError) Error() string {
+	msg := e.Message
+	if e.Name != "" {
+		msg = e.Name + ": " + msg
+	}
+	switch {
+	case e.File != "" && e.Column == 0:
+		msg = fmt.Sprintf("%s (%s:%d)", msg, e.File, e.Line)
+	case e.File != "":
+		msg = fmt.Sprintf("%s (%s:%d:%d)", msg, e.File, e.Line, e.Column)
+	}
+	return fmt.Sprintf("rendering %s: %s", e.Path, msg)
+}
+
+// stackFrame matches the location of a QuickJS stack frame, e.g. "at render (server:12)"
+var stackFrame = regexp.MustCompile(`at [^\n]*?\(?([^\s():]+):(\d+)(?::(\d+))?\)?\n`)
+
+// newRenderError builds a RenderError from the value thrown by the bundle
+func newRenderError(path string, thrown quickjs.Value) *RenderError {
+	renderErr := &RenderError{Path: path}
+	if thrown.IsError() || thrown.IsObject() {
+		name, message, stack := thrown.Get("name"), thrown.Get("message"), thrown.Get("stack")
+		defer name.Free()
+		defer message.Free()
+		defer stack.Free()
+		if !name.IsUndefined() {
+			renderErr.Name = name.String()
+		}
+		if !message.IsUndefined() {
+			renderErr.Message = message.String()
+		}
+		if !stack.IsUndefined() {
+			renderErr.Stack = stack.String()
+		}
+	} else {
+		renderErr.Message = thrown.String()
+	}
+	renderErr.locate()
+	return renderErr
+}
+
+// renderErrorFrom converts an uncaught exception returned by quickjs
+func renderErrorFrom(path string, err error) *RenderError {
+	if err == nil {
+		return &RenderError{Path: path, Message: "unknown exception"}
+	}
+	renderErr := &RenderError{Path: path, Message: err.Error()}
+	if jsErr, ok := err.(*quickjs.Error); ok {
+		renderErr.Message = jsErr.Cause
+		renderErr.Stack = jsErr.Stack
+	}
+	renderErr.locate()
+	return renderErr
+}
+
+// evalFile is the file QuickJS reports for the script that starts a render
+const evalFile = "<input>"
+
+// locate fills File, Line and Column from the first stack frame with a location,
+// skipping the render script itself. Minified bundles have no line information
+func (e *RenderError) locate() {
+	for _, match := range stackFrame.FindAllStringSubmatch(e.Stack+"\n", -1) {
+		if match[1] == evalFile {
+			continue
+		}
+		e.File = match[1]
+		e.Line, _ = strconv.Atoi(match[2])
+		if match[3] != "" {
+			e.Column, _ = strconv.Atoi(match[3])
+		}
+		return
+	}
+}
+
+// BuildError is returned when esbuild reports errors for a bundle
+type BuildError struct {
+	Messages []BuildMessage
+}
+
+// BuildMessage is a single esbuild diagnostic
+type BuildMessage struct {
+	Text     string
+	File     string // path relative to the working directory, empty when the error has no location
+	Line     int    // 1-based
+	Column   int    // 0-based, in bytes
+	LineText string // the source line the error points at
+}
+
+func (e *BuildError) Error() string {
+	if len(e.Messages) == 0 {
+		return "build error"
+	}
+	m := e.Messages[0]
+	if m.File == "" {
+		return fmt.Sprintf("build error: %s", m.Text)
+	}
+	return fmt.Sprintf("build error: %s (%s:%d:%d)", m.Text, m.File, m.Line, m.Column)
+}
+
+// newBuildError converts the errors reported by esbuild
+func newBuildError(messages []esbuild.Message) *BuildError {
+	buildErr := &BuildError{}
+	for _, message := range messages {
+		m := BuildMessage{Text: message.Text}
+		if loc := message.Location; loc != nil {
+			m.File, m.Line, m.Column, m.LineText = loc.File, loc.Line, loc.Column, loc.LineText
+		}
+		buildErr.Messages = append(buildErr.Messages, m)
+	}
+	return buildErr
+}
+
+// CodeFrame returns the lines of source around line with a marker under the 0-based column.
+// A negative column leaves the marker out, a line outside of source returns an empty frame
+func CodeFrame(source string, line, column int) string {
+	lines := strings.Split(source, "\n")
+	if line < 1 || line > len(lines) {
+		return ""
+	}
+	start, end := max(line-2, 1), min(line+2, len(lines))
+	width := len(strconv.Itoa(end))
+
+	var frame strings.Builder
+	for n := start; n <= end; n++ {
+		marker := "  "
+		if n == line {
+			marker = "> "
+		}
+		fmt.Fprintf(&frame, "%s%*d | %s\n", marker, width, n, lines[n-1])
+		if n == line && column >= 0 {
+			fmt.Fprintf(&frame, "  %*s | %s^\n", width, "", strings.Repeat(" ", column))
+		}
+	}
+	return strings.TrimSuffix(frame.String(), "\n")
+}
@@ -1,11 +1,11 @@
 package pkg
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strings"
 
-	"github.com/buke/quickjs-go"
 	"github.com/rs/zerolog"
 
 	esbuild "github.com/evanw/esbuild/pkg/api"
@@ -56,8 +56,31 @@ func MatchPath(routePath, actualPath string) (bool, map[string]string) {
 }
 
 type BuildResult struct {
-	JS  string
-	CSS string
+	JS      string
+	CSS     string
+	JSPath  string            // public URL of the hashed client script
+	CSSPath string            // public URL of the hashed client stylesheet
+	Files   map[string][]byte // client output served under AssetsPrefix, keyed by file name
+	Chunks  map[string]Chunk  // client chunk graph, keyed by file name
+
+	SourceMap string // external source map of the server bundle
+}
+
+// AppendCSS adds css to the client stylesheet and renames it after its new content
+func (b *BuildResult) AppendCSS(css string) {
+	if css == "" {
+		return
+	}
+	if b.Files == nil {
+		b.Files = make(map[string][]byte)
+	}
+	if b.CSSPath != "" {
+		delete(b.Files, strings.TrimPrefix(b.CSSPath, AssetsPrefix))
+	}
+	b.CSS = fmt.Sprintf("%s\n%s", b.CSS, css)
+	name := HashName("client", ".css", []byte(b.CSS))
+	b.Files[name] = []byte(b.CSS)
+	b.CSSPath = AssetsPrefix + name
 }
 
 var Loader = map[string]esbuild.Loader{
@@ -91,33 +114,62 @@ var Loader = map[string]esbuild.Loader{
 }
 
 func (j JobRunner) BuildClient() (BuildResult, error) {
+	return j.clientResult(esbuild.Build(j.clientOptions()))
+}
+
+func (j JobRunner) clientOptions() esbuild.BuildOptions {
 	env := j.Env
-	opt := esbuild.Build(esbuild.BuildOptions{
+	return esbuild.BuildOptions{
 		EntryPoints:       []string{j.ClientEntryPoint},
 		Outdir:            "/",
-		AssetNames:        fmt.Sprintf("%s/[name]", strings.TrimPrefix("/assets/", "/")),
+		EntryNames:        "client.[hash]",
+		ChunkNames:        "chunk.[hash]",
+		AssetNames:        "assets/[name]-[hash]",
+		PublicPath:        AssetsPrefix,
 		Bundle:            true,
+		Splitting:         true,
+		Format:            esbuild.FormatESModule,
 		Target:            esbuild.ES2020,
 		Write:             false,
-		Metafile:          false,
+		Metafile:          true,
 		MinifyWhitespace:  env == "production",
 		MinifyIdentifiers: env == "production",
 		MinifySyntax:      env == "production",
 		KeepNames:         true,
 		Loader:            Loader,
-	})
+		Define: map[string]string{
+			"global": "globalThis",
+		},
+	}
+}
 
+// clientResult collects the client output of a build or rebuild
+func (j JobRunner) clientResult(opt esbuild.BuildResult) (BuildResult, error) {
 	if len(opt.Errors) > 0 {
-		return BuildResult{},
-			fmt.Errorf("build error: %v", opt.Errors[0].Text)
+		return BuildResult{}, newBuildError(opt.Errors)
 	}
 
-	result := BuildResult{}
+	chunks, err := parseChunks(opt.Metafile)
+	if err != nil {
+		return BuildResult{}, fmt.Errorf("build error: %v", err)
+	}
+
+	result := BuildResult{Files: make(map[string][]byte), Chunks: chunks}
 	for _, file := range opt.OutputFiles {
-		if strings.HasSuffix(file.Path, ".css") {
-			result.CSS = string(file.Contents)
-		} else if strings.HasSuffix(file.Path, ".js") {
-			result.JS = string(file.Contents)
+		result.Files[strings.TrimPrefix(file.Path, "/")] = file.Contents
+	}
+
+	// Chunks and route stylesheets are loaded on demand, only the entry is referenced by the page
+	entryPoint := sourcePath(j.ClientEntryPoint)
+	for name, chunk := range chunks {
+		if chunk.EntryPoint != entryPoint {
+			continue
+		}
+		result.JS = string(result.Files[name])
+		result.JSPath = AssetsPrefix + name
+		if chunk.CSS != "" {
+			result.CSS = string(result.Files[chunk.CSS])
+			result.CSSPath = AssetsPrefix + chunk.CSS
 		}
 	}
 
@@ -125,9 +177,12 @@ func (j JobRunner) BuildClient() (BuildResult, error) {
 }
 
 func (j JobRunner) BuildServer() (BuildResult, error) {
-	env := j.Env
+	return j.serverResult(esbuild.Build(j.serverOptions()))
+}
 
-	opt := esbuild.Build(esbuild.BuildOptions{
+func (j JobRunner) serverOptions() esbuild.BuildOptions {
+	env := j.Env
+	return esbuild.BuildOptions{
 		EntryPoints:       []string{j.ServerEntryPoint},
 		Bundle:            true,
 		Write:             false,
@@ -135,20 +190,27 @@ func (j JobRunner) BuildServer() (BuildResult, error) {
 		Format:            esbuild.FormatESModule, // Use ES Module format
 		Platform:          esbuild.PlatformBrowser,
 		Target:            esbuild.ES2020,
-		AssetNames:        fmt.Sprintf("%s/[name]", strings.TrimPrefix("/assets/", "/")),
-		MinifyWhitespace:  env == "production",
+		AssetNames:        "assets/[name]-[hash]",
+		PublicPath:        AssetsPrefix,
+		MinifyWhitespace:  false, // QuickJS frames only carry a line, production bundles keep theirs to map them
 		MinifyIdentifiers: env == "production",
 		KeepNames:         true,
 		MinifySyntax:      env == "production",
+		Sourcemap:         esbuild.SourceMapExternal,
 		Banner: map[string]string{
 			"js": textEncoderPolyfill + processPolyfill + consolePolyfill,
 		},
+		Define: map[string]string{
+			"global": "globalThis",
+		},
 		Loader: Loader,
-	})
+	}
+}
 
+// serverResult collects the server bundle and its source map from a build or rebuild
+func (j JobRunner) serverResult(opt esbuild.BuildResult) (BuildResult, error) {
 	if len(opt.Errors) > 0 {
-		return BuildResult{},
-			fmt.Errorf("build error: %v", opt.Errors[0].Text)
+		return BuildResult{}, newBuildError(opt.Errors)
 	}
 
 	result := BuildResult{}
@@ -157,52 +219,18 @@ func (j JobRunner) BuildServer() (BuildResult, error) {
 			result.CSS = string(file.Contents)
 		} else if strings.HasSuffix(file.Path, ".js") {
 			result.JS = string(file.Contents)
+		} else if strings.HasSuffix(file.Path, ".js.map") {
+			result.SourceMap = string(file.Contents)
 		}
 	}
 
 	return result, nil
 }
 
+// RenderServer renders path with a one-off runtime. Use a RuntimePool to
+// reuse runtimes between requests
 func RenderServer(js string, path string) (string, error) {
-	// Initialize QuickJS runtime with module support
-	rt := quickjs.NewRuntime(quickjs.WithModuleImport(true))
-	defer rt.Close()
-
-	ctx := rt.NewContext()
-	defer ctx.Close()
-
-	_, err := ctx.LoadModule(js, "server")
-	if err != nil {
-		panic(err)
-	}
-
-	opt := quickjs.EvalAwait(true)
-
-	// Print the JSON representation
-	script := fmt.Sprintf(`
-      globalThis.URL = class {
-          constructor(url) {
-            this.href = url;
-          }
-        };
-        const window = {
-          location: {
-            pathname: "%s"
-          }
-        };
-      async function start() {
-          try {
-              const { render } = await import("server");
-              const { html } = render("%s");  // Use the dynamic path here
-              globalThis.result = html;
-          } catch (e) {
-              globalThis.result = "Error: " + e.toString();
-          }
-      }
-      start();`, path, path)
-	_, err = ctx.Eval(script, opt)
-	if err != nil {
-		panic(err)
-	}
-	return ctx.Globals().Get("result").String(), nil
+	pool := NewRuntimePool(js, nil, 1)
+	defer pool.Close()
+	return pool.Render(context.Background(), RenderRequest{Path: path})
 }
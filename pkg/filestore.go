@@ -0,0 +1,183 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStore is a CacheStore that keeps every page in a JSON file of a directory.
+// It survives restarts and can be shared by replicas on the same volume, it is not bounded
+type FileStore struct {
+	Dir    string
+	MaxAge time.Duration // how long a page without Expires is kept, IDs change with every build so older pages are never read again, zero keeps it
+}
+
+// NewFileStore creates a FileStore in dir keeping pages without Expires for 24h,
+// creating the directory if needed
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir, MaxAge: 24 * time.Hour}, nil
+}
+
+// file returns the file of the entry with id, IDs hold query strings and headers so they are hashed
+func (s *FileStore) file(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return filepath.Join(s.Dir, hex.EncodeToString(sum[:])+".json")
+}
+
+// read returns the entry in file and when it was written
+func (s *FileStore) read(file string) (Cache, time.Time, error) {
+	var cache Cache
+	f, err := os.Open(file)
+	if err != nil {
+		return cache, time.Time{}, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return cache, time.Time{}, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return cache, time.Time{}, err
+	}
+	err = json.Unmarshal(data, &cache)
+	return cache, info.ModTime(), err
+}
+
+// dead reports whether the entry written at modified can no longer be served
+func (s *FileStore) dead(cache Cache, modified, now time.Time) bool {
+	if cache.Expires.IsZero() && s.MaxAge > 0 {
+		return !now.Before(modified.Add(s.MaxAge))
+	}
+	return cache.dead(now)
+}
+
+// Get reads the entry with id, removing it once it can no longer be served
+func (s *FileStore) Get(id string) (Cache, bool, error) {
+	file := s.file(id)
+	cache, modified, err := s.read(file)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Cache{}, false, nil
+	}
+	if err != nil {
+		return Cache{}, false, err
+	}
+	if s.dead(cache, modified, time.Now()) {
+		return Cache{}, false, s.remove(file)
+	}
+	return cache, true, nil
+}
+
+// Set writes the entry through a temporary file, so readers never see a partial page
+func (s *FileStore) Set(cache Cache) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(s.Dir, ".page-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.file(cache.ID))
+}
+
+// Delete removes the entries match reports true for
+func (s *FileStore) Delete(match func(Cache) bool) (int, error) {
+	removed := 0
+	err := s.walk(func(file string, cache Cache, _ time.Time) error {
+		if !match(cache) {
+			return nil
+		}
+		removed++
+		return s.remove(file)
+	})
+	return removed, err
+}
+
+// Entries reads every entry
+func (s *FileStore) Entries() ([]Cache, error) {
+	var entries []Cache
+	err := s.walk(func(_ string, cache Cache, _ time.Time) error {
+		entries = append(entries, cache)
+		return nil
+	})
+	return entries, err
+}
+
+// Stats returns the number and size of the entries
+func (s *FileStore) Stats() (CacheStats, error) {
+	var stats CacheStats
+	err := s.walk(func(_ string, cache Cache, _ time.Time) error {
+		stats.Entries++
+		stats.Bytes += cache.size()
+		return nil
+	})
+	return stats, err
+}
+
+// DeleteExpired removes the entries that can no longer be served or outlived MaxAge
+func (s *FileStore) DeleteExpired() error {
+	now := time.Now()
+	return s.walk(func(file string, cache Cache, modified time.Time) error {
+		if !s.dead(cache, modified, now) {
+			return nil
+		}
+		return s.remove(file)
+	})
+}
+
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// walk calls fn with every entry in the directory and when it was written.
+// Files removed by another replica in the meantime are skipped
+func (s *FileStore) walk(fn func(file string, cache Cache, modified time.Time) error) error {
+	files, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range files {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		file := filepath.Join(s.Dir, entry.Name())
+		cache, modified, err := s.read(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(file, cache, modified); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *FileStore) remove(file string) error {
+	if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
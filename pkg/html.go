@@ -2,6 +2,7 @@ package pkg
 
 import (
 	"bytes"
+	"fmt"
 	"html/template"
 )
 
@@ -30,33 +31,130 @@ const templateHTML = `<!doctype html>
     <script src="{{.}}"></script>
     {{ end }}
 
-    {{ if .CSS }}
-    <style>
-      {{ .CSS }}
-    </style>
+    {{ range .Preloads }}
+    <link href="{{ . }}" rel="modulepreload" />
+    {{ end }}
+
+    {{ if .CSSPath }}
+    <link id="__LUNA_CSS__" href="{{ .CSSPath }}" rel="stylesheet" />
     {{ end }}
 
     {{if .Dev}}
     <script>
-      let socket = new WebSocket("{{ .SWUrl }}");
-      socket.onopen = () => {
-      socket.send(1);
-      };
-
-      socket.onmessage = (event) => {
-      if (event.data === "reload") {
-        console.log("Change detected, reloading...");
-        window.location.reload();
-      }
-      };
+      (function () {
+        // Client entries that can be imported again without a reload call window.__luna_hmr.accept()
+        // every time they run and keep what they need across updates in window.__luna_hmr.data.
+        // Every module is evaluated again, React remounts the tree and component state is lost
+        var hmr = (window.__luna_hmr = {
+          data: {},
+          accepted: false,
+          accept: function () {
+            hmr.accepted = true;
+          },
+        });
+        var reload = function () {
+          console.log("Change detected, reloading...");
+          window.location.reload();
+        };
+
+        // The overlay lists build and render errors until the next successful build
+        var stale = false;
+        var showErrors = function (errors) {
+          hideErrors();
+          var overlay = document.createElement("div");
+          overlay.id = "__luna_overlay";
+          overlay.style.cssText =
+            "position:fixed;inset:0;z-index:2147483647;overflow:auto;padding:32px;" +
+            "background:rgba(24,24,27,0.95);color:#f4f4f5;font:14px/1.5 ui-monospace,monospace";
+          errors.forEach(function (error) {
+            var title = document.createElement("h2");
+            title.style.cssText = "margin:0 0 8px;color:#f87171;font-size:16px";
+            title.textContent = (error.kind === "build" ? "Build error: " : "Render error: ") + error.message;
+            overlay.appendChild(title);
+            if (error.file) {
+              var where = document.createElement("div");
+              where.style.cssText = "margin-bottom:8px;color:#a1a1aa";
+              where.textContent = error.file + ":" + error.line + ":" + error.column;
+              overlay.appendChild(where);
+            }
+            [error.frame, error.stack].forEach(function (text) {
+              if (!text) return;
+              var pre = document.createElement("pre");
+              pre.style.cssText = "margin:0 0 16px;padding:12px;background:#27272a;overflow:auto";
+              pre.textContent = text;
+              overlay.appendChild(pre);
+            });
+          });
+          document.body.appendChild(overlay);
+        };
+        var hideErrors = function () {
+          var overlay = document.getElementById("__luna_overlay");
+          if (overlay) overlay.remove();
+        };
+        {{ if .DevErrors }}
+        stale = true;
+        window.addEventListener("DOMContentLoaded", function () {
+          showErrors({{ .DevErrors }});
+        });
+        {{ end }}
+
+        var socket = new WebSocket("{{ .SWUrl }}");
+        socket.onopen = function () {
+          socket.send(window.location.pathname);
+        };
+        socket.onmessage = function (event) {
+          var message;
+          try {
+            message = JSON.parse(event.data);
+          } catch (e) {
+            message = { type: event.data };
+          }
+          if (message.type === "connected") {
+            return;
+          }
+          if (message.type === "error") {
+            showErrors(message.errors || []);
+            return;
+          }
+          hideErrors();
+          if (stale) {
+            reload();
+          } else if (message.type === "css") {
+            var current = document.getElementById("__LUNA_CSS__");
+            var next = document.createElement("link");
+            next.rel = "stylesheet";
+            next.href = message.path;
+            next.onload = function () {
+              if (current) current.remove();
+              next.id = "__LUNA_CSS__";
+            };
+            document.head.appendChild(next);
+          } else if (message.type === "update" && hmr.accepted) {
+            hmr.accepted = false;
+            import(message.path).then(function () {
+              if (!hmr.accepted) reload();
+            }, reload);
+          } else {
+            reload();
+          }
+        };
+      })();
     </script>
     {{end}}
   </head>
   <body>
-    <div id="root">{{ .RenderedContent }}</div>
-    <script type="module">
-      {{ .JS }}
+    <div id="root"{{ if .ClientOnly }} data-client-only{{ end }}>{{ .RenderedContent }}</div>
+    <script id="__LUNA_DATA__" type="application/json">{{ .Data }}</script>
+    <script>
+      (function () {
+        var data = JSON.parse(document.getElementById("__LUNA_DATA__").textContent || "{}");
+        window.props = data.props || {};
+        window.store = data.store || {};
+      })();
     </script>
+    {{ if .JSPath }}
+    <script src="{{ .JSPath }}" type="module"></script>
+    {{ end }}
   </body>
 </html>
 `
@@ -75,10 +173,14 @@ type CreateTemplateData struct {
 	Favicon         string
 	CssLinks        []template.HTML
 	JsLinks         []template.HTML
-	CSS             template.CSS
-	JS              template.JS
+	CSSPath         string
+	JSPath          string
+	Preloads        []string
+	Data            template.JS // JSON payload with the page props and store
 	RenderedContent template.HTML
+	ClientOnly      bool // the server render failed, the client renders into an empty root
 	Dev             bool
+	DevErrors       template.JS // JSON list of errors the dev overlay shows on load
 	SWUrl           string
 	MainHead        []template.HTML
 }
@@ -104,3 +206,22 @@ func CreateTemplate(data CreateTemplateData) (*template.Template, error) {
 
 	return baseTemplate, nil
 }
+
+// streamMarker stands in for the rendered content when a page is split for streaming
+const streamMarker = "<!--luna-stream-->"
+
+// SplitTemplate executes tmpl and splits the document around the root element's content,
+// so the head can be flushed before the body has been rendered
+func SplitTemplate(tmpl *template.Template, data CreateTemplateData) (head []byte, tail []byte, err error) {
+	data.RenderedContent = template.HTML(streamMarker)
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, nil, err
+	}
+	head, tail, found := bytes.Cut(buf.Bytes(), []byte(streamMarker))
+	if !found {
+		return nil, nil, fmt.Errorf("template has no rendered content")
+	}
+	return head, tail, nil
+}
@@ -0,0 +1,56 @@
+package pkg
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrRenderTimeout is wrapped by a RenderLimitError when a render runs longer than its timeout
+	ErrRenderTimeout = errors.New("render timeout exceeded")
+	// ErrRenderMemory is wrapped by a RenderLimitError when a render exceeds the memory limit
+	ErrRenderMemory = errors.New("render memory limit exceeded")
+	// ErrRenderStack is wrapped by a RenderLimitError when a render exceeds the stack size limit
+	ErrRenderStack = errors.New("render stack size exceeded")
+)
+
+// RenderLimits bounds the resources a single server render may use. Zero values mean no limit
+type RenderLimits struct {
+	Timeout      time.Duration // wall-clock time of one render
+	MemoryLimit  uint64        // bytes allocated by the runtime, including the loaded server bundle
+	MaxStackSize uint64        // bytes of stack the JS code may use
+}
+
+// Merge returns l with every non-zero limit of override applied
+func (l RenderLimits) Merge(override *RenderLimits) RenderLimits {
+	if override == nil {
+		return l
+	}
+	if override.Timeout != 0 {
+		l.Timeout = override.Timeout
+	}
+	if override.MemoryLimit != 0 {
+		l.MemoryLimit = override.MemoryLimit
+	}
+	if override.MaxStackSize != 0 {
+		l.MaxStackSize = override.MaxStackSize
+	}
+	return l
+}
+
+// RenderLimitError is returned when a render is aborted by one of its RenderLimits.
+// Use errors.Is with ErrRenderTimeout, ErrRenderMemory or ErrRenderStack to tell them apart
+type RenderLimitError struct {
+	Path   string
+	Limits RenderLimits
+	Err    error
+}
+
+func (e *RenderLimitError) Error() string {
+	return fmt.Sprintf("rendering %s: %s", e.Path, e.Err)
+}
+
+func (e *RenderLimitError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,172 @@
+package pkg
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ManifestFile is the name of the manifest in a build directory
+const ManifestFile = "manifest.json"
+
+// Manifest describes the bundles written to a build directory.
+// Client files live under "client/", keyed like BuildResult.Files
+type Manifest struct {
+	JSPath    string           `json:"jsPath"`              // public URL of the client entry
+	CSSPath   string           `json:"cssPath,omitempty"`   // public URL of the client stylesheet
+	Chunks    map[string]Chunk `json:"chunks"`              // client chunk graph, keyed by file name
+	Server    string           `json:"server"`              // server bundle, relative to the build directory
+	SourceMap string           `json:"sourceMap,omitempty"` // source map of the server bundle, relative to the build directory
+}
+
+// WriteBuild writes the client and server bundles and their manifest to dir,
+// replacing the client files of a previous build
+func WriteBuild(dir string, client, server BuildResult) error {
+	if err := os.RemoveAll(filepath.Join(dir, "client")); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, content := range client.Files {
+		path := filepath.Join(dir, "client", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return err
+		}
+		if err := os.WriteFile(path, content, 0644); err != nil {
+			return err
+		}
+	}
+
+	manifest := Manifest{
+		JSPath:  client.JSPath,
+		CSSPath: client.CSSPath,
+		Chunks:  client.Chunks,
+		Server:  "server.js",
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifest.Server), []byte(server.JS), 0644); err != nil {
+		return err
+	}
+	if server.SourceMap != "" {
+		manifest.SourceMap = "server.js.map"
+		if err := os.WriteFile(filepath.Join(dir, manifest.SourceMap), []byte(server.SourceMap), 0644); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dir, ManifestFile), data, 0644)
+}
+
+// BuildOptions describes the production build Build writes
+type BuildOptions struct {
+	ServerEntryPoint string
+	ClientEntryPoint string
+	TailwindCSS      bool   // append the Tailwind output to the client stylesheet
+	RootPath         string // directory Tailwind runs in
+}
+
+// Build bundles the entry points for production and writes them to dir with WriteBuild.
+// It needs no Engine, so a build can run before the app that embeds it compiles
+func Build(dir string, options BuildOptions) error {
+	job := JobRunner{
+		ServerEntryPoint: options.ServerEntryPoint,
+		ClientEntryPoint: options.ClientEntryPoint,
+		Env:              "production",
+	}
+	client, err := job.BuildClient()
+	if err != nil {
+		return err
+	}
+	server, err := job.BuildServer()
+	if err != nil {
+		return err
+	}
+	if options.TailwindCSS {
+		client.AppendCSS(Tailwind(options.RootPath))
+	}
+	return WriteBuild(dir, client, server)
+}
+
+// Prebuilt is a Bundler that loads the bundles written by WriteBuild instead of building them.
+// FS is the build directory, os.DirFS or a sub tree of an embedded filesystem
+type Prebuilt struct {
+	FS fs.FS
+}
+
+func (p Prebuilt) manifest() (Manifest, error) {
+	var manifest Manifest
+	data, err := fs.ReadFile(p.FS, ManifestFile)
+	if err != nil {
+		return manifest, err
+	}
+	err = json.Unmarshal(data, &manifest)
+	return manifest, err
+}
+
+// BuildClient loads the client files listed in the manifest
+func (p Prebuilt) BuildClient() (BuildResult, error) {
+	manifest, err := p.manifest()
+	if err != nil {
+		return BuildResult{}, err
+	}
+
+	result := BuildResult{
+		JSPath:  manifest.JSPath,
+		CSSPath: manifest.CSSPath,
+		Chunks:  manifest.Chunks,
+		Files:   make(map[string][]byte),
+	}
+	err = fs.WalkDir(p.FS, "client", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(p.FS, name)
+		if err != nil {
+			return err
+		}
+		result.Files[strings.TrimPrefix(name, "client/")] = content
+		return nil
+	})
+	if err != nil {
+		return BuildResult{}, err
+	}
+
+	js, ok := result.Files[strings.TrimPrefix(manifest.JSPath, AssetsPrefix)]
+	if !ok {
+		return BuildResult{}, errors.New("manifest: client entry is missing from the build")
+	}
+	result.JS = string(js)
+	if manifest.CSSPath != "" {
+		result.CSS = string(result.Files[strings.TrimPrefix(manifest.CSSPath, AssetsPrefix)])
+	}
+	return result, nil
+}
+
+// BuildServer loads the server bundle and its source map
+func (p Prebuilt) BuildServer() (BuildResult, error) {
+	manifest, err := p.manifest()
+	if err != nil {
+		return BuildResult{}, err
+	}
+
+	js, err := fs.ReadFile(p.FS, manifest.Server)
+	if err != nil {
+		return BuildResult{}, err
+	}
+	result := BuildResult{JS: string(js)}
+	if manifest.SourceMap != "" {
+		sourceMap, err := fs.ReadFile(p.FS, manifest.SourceMap)
+		if err != nil {
+			return BuildResult{}, err
+		}
+		result.SourceMap = string(sourceMap)
+	}
+	return result, nil
+}
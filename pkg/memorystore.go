@@ -0,0 +1,128 @@
+package pkg
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// DefaultCacheMaxEntries bounds a MemoryStore created without any bound
+const DefaultCacheMaxEntries = 1000
+
+// MemoryStore is the default CacheStore, an LRU of the pages in this process.
+// The least recently used pages are evicted once either bound is exceeded
+type MemoryStore struct {
+	maxEntries int
+	maxBytes   int64
+	mu         sync.Mutex
+	entries    map[string]*list.Element // ID -> element of lru holding a Cache
+	lru        *list.List               // most recently used first
+	size       int64                    // total size of the entries
+	evictions  int64
+}
+
+// NewMemoryStore creates a MemoryStore bounded by a number of entries and their total size in bytes,
+// zero values mean no bound and maxEntries defaults to DefaultCacheMaxEntries when both are zero
+func NewMemoryStore(maxEntries int, maxBytes int64) *MemoryStore {
+	if maxEntries == 0 && maxBytes == 0 {
+		maxEntries = DefaultCacheMaxEntries
+	}
+	return &MemoryStore{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+}
+
+// Get returns the entry with id and marks it as recently used
+func (s *MemoryStore) Get(id string) (Cache, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	element, ok := s.entries[id]
+	if !ok {
+		return Cache{}, false, nil
+	}
+	cache := element.Value.(Cache)
+	if cache.dead(time.Now()) {
+		s.remove(element)
+		return Cache{}, false, nil
+	}
+	s.lru.MoveToFront(element)
+	return cache, true, nil
+}
+
+// Set adds an entry, replacing the entry with the same ID, and evicts
+// the least recently used entries that no longer fit. A page larger than maxBytes is not cached
+func (s *MemoryStore) Set(cache Cache) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if element, ok := s.entries[cache.ID]; ok {
+		s.remove(element)
+	}
+	if s.maxBytes > 0 && cache.size() > s.maxBytes {
+		return nil
+	}
+	s.entries[cache.ID] = s.lru.PushFront(cache)
+	s.size += cache.size()
+
+	for s.lru.Len() > 0 && ((s.maxEntries > 0 && s.lru.Len() > s.maxEntries) ||
+		(s.maxBytes > 0 && s.size > s.maxBytes)) {
+		s.remove(s.lru.Back())
+		s.evictions++
+	}
+	return nil
+}
+
+// Delete removes the entries match reports true for
+func (s *MemoryStore) Delete(match func(Cache) bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	removed := 0
+	for _, element := range s.entries {
+		if match(element.Value.(Cache)) {
+			s.remove(element)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Entries returns every entry
+func (s *MemoryStore) Entries() ([]Cache, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]Cache, 0, len(s.entries))
+	for _, element := range s.entries {
+		entries = append(entries, element.Value.(Cache))
+	}
+	return entries, nil
+}
+
+// Stats returns the number and size of the entries and how many were evicted
+func (s *MemoryStore) Stats() (CacheStats, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return CacheStats{Entries: s.lru.Len(), Bytes: s.size, Evictions: s.evictions}, nil
+}
+
+// DeleteExpired removes the entries that can no longer be served
+func (s *MemoryStore) DeleteExpired() error {
+	_, err := s.Delete(func(cache Cache) bool { return cache.dead(time.Now()) })
+	return err
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// remove drops element from the store, s.mu must be held
+func (s *MemoryStore) remove(element *list.Element) {
+	cache := s.lru.Remove(element).(Cache)
+	delete(s.entries, cache.ID)
+	s.size -= cache.size()
+}
@@ -0,0 +1,52 @@
+package pkg
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// CachePolicy caches each render of a route for a relative lifetime
+type CachePolicy struct {
+	TTL                  time.Duration // how long a render is fresh, zero disables the policy
+	StaleWhileRevalidate time.Duration // how long after TTL the stale page is served while it renders again in the background
+	StaleIfError         time.Duration // how long after the page expired it is still served when rendering it again fails
+}
+
+// CacheControl returns the Cache-Control header of a page rendered age ago.
+// Private pages are kept out of shared caches such as CDNs
+func (p CachePolicy) CacheControl(age time.Duration, private bool) string {
+	directives := []string{"public"}
+	if private {
+		directives[0] = "private"
+	}
+	directives = append(directives, fmt.Sprintf("max-age=%d", int64(max(p.TTL-age, 0).Round(time.Second).Seconds())))
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", int64(p.StaleWhileRevalidate.Seconds())))
+	}
+	if p.StaleIfError > 0 {
+		directives = append(directives, fmt.Sprintf("stale-if-error=%d", int64(p.StaleIfError.Seconds())))
+	}
+	return strings.Join(directives, ", ")
+}
+
+// Cacheable reports whether the pages of the route are cached
+func (r ReactRoute) Cacheable() bool {
+	return r.CachePolicy.TTL > 0 || r.CacheExpiry != 0 || r.Revalidate > 0
+}
+
+// CacheLifetime returns when a page of the route rendered at renderedAt goes stale and expires,
+// zero times never do. CachePolicy takes precedence over CacheExpiry and Revalidate
+func (r ReactRoute) CacheLifetime(renderedAt time.Time) (staleAt, expires time.Time, staleIfError time.Duration) {
+	if policy := r.CachePolicy; policy.TTL > 0 {
+		staleAt = renderedAt.Add(policy.TTL)
+		return staleAt, staleAt.Add(policy.StaleWhileRevalidate), policy.StaleIfError
+	}
+	if r.Revalidate > 0 {
+		staleAt = renderedAt.Add(r.Revalidate)
+	}
+	if r.CacheExpiry != 0 {
+		expires = time.Unix(r.CacheExpiry, 0)
+	}
+	return staleAt, expires, 0
+}
@@ -0,0 +1,565 @@
+package pkg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buke/quickjs-go"
+)
+
+// ErrPoolClosed is returned when a runtime is requested from a closed pool
+var ErrPoolClosed = errors.New("runtime pool is closed")
+
+// ErrNoRuntimePool is returned when rendering through a pool that was never created
+var ErrNoRuntimePool = errors.New("no runtime pool")
+
+// defaultMaxStackSize is JS_DEFAULT_STACK_SIZE of QuickJS, restored after a render with a stack limit
+const defaultMaxStackSize = 256 << 10
+
+// RenderRequest describes a single server render
+type RenderRequest struct {
+	Path   string
+	Props  map[string]interface{}
+	Store  map[string]interface{}
+	Limits RenderLimits
+}
+
+// RuntimePool keeps a fixed number of QuickJS runtimes with the server bundle
+// already loaded, so a render only has to call into the bundle
+type RuntimePool struct {
+	size      int
+	workers   chan *Worker
+	mu        sync.RWMutex
+	js        string
+	sourceMap *SourceMap
+	gen       uint64
+	closed    bool
+}
+
+// Worker owns a single QuickJS runtime. QuickJS runtimes are not thread safe,
+// so every call into the runtime is executed on the goroutine that created it
+type Worker struct {
+	pool      *RuntimePool
+	gen       uint64
+	sourceMap *SourceMap // maps errors of the bundle this worker loaded
+	jobs      chan func()
+	done      chan struct{}
+	rt        quickjs.Runtime
+	ctx       *quickjs.Context
+	loadErr   error
+	write     func(chunk string) error // destination of the render in progress
+
+	deadline    time.Time // wall-clock limit of the render in progress
+	interrupted bool      // the render in progress was stopped by the interrupt handler
+	broken      bool      // the runtime hit a limit or panicked and must not be reused
+}
+
+// NewRuntimePool creates a pool of size runtimes with js loaded as the "server" module.
+// Render errors are translated with sourceMap when it is not nil.
+// A size of 0 or less uses the number of CPUs
+func NewRuntimePool(js string, sourceMap *SourceMap, size int) *RuntimePool {
+	if size <= 0 {
+		size = runtime.NumCPU()
+	}
+	p := &RuntimePool{
+		size:      size,
+		workers:   make(chan *Worker, size),
+		js:        js,
+		sourceMap: sourceMap,
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < size; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			p.workers <- newWorker(p, js, sourceMap, 0)
+		}()
+	}
+	wg.Wait()
+	return p
+}
+
+// Size returns the number of runtimes managed by the pool
+func (p *RuntimePool) Size() int {
+	return p.size
+}
+
+// Acquire checks a runtime out of the pool, waiting until one is free or ctx is done.
+// Every acquired worker must be handed back with Release
+func (p *RuntimePool) Acquire(ctx context.Context) (*Worker, error) {
+	if p == nil || p.size == 0 {
+		return nil, ErrNoRuntimePool
+	}
+	p.mu.RLock()
+	closed := p.closed
+	p.mu.RUnlock()
+	if closed {
+		return nil, ErrPoolClosed
+	}
+
+	select {
+	case w := <-p.workers:
+		p.mu.RLock()
+		if w.gen != p.gen {
+			w.close()
+			w = newWorker(p, p.js, p.sourceMap, p.gen)
+		}
+		p.mu.RUnlock()
+		return w, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Release returns a worker to the pool. Workers loaded with an outdated bundle
+// are closed and replaced with a fresh runtime
+func (p *RuntimePool) Release(w *Worker) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.closed {
+		w.close()
+		return
+	}
+	if w.gen != p.gen || w.broken {
+		w.close()
+		w = newWorker(p, p.js, p.sourceMap, p.gen)
+	}
+	p.workers <- w
+}
+
+// Reload swaps the server bundle. Idle runtimes are recycled immediately,
+// runtimes that are checked out are recycled when they are released
+func (p *RuntimePool) Reload(js string, sourceMap *SourceMap) {
+	p.mu.Lock()
+	p.js = js
+	p.sourceMap = sourceMap
+	p.gen++
+	gen := p.gen
+	p.mu.Unlock()
+
+	for i := 0; i < p.size; i++ {
+		select {
+		case w := <-p.workers:
+			if w.gen != gen {
+				w.close()
+				w = newWorker(p, js, sourceMap, gen)
+			}
+			p.workers <- w
+		default:
+			return
+		}
+	}
+}
+
+// Close shuts down every idle runtime; checked out runtimes are closed on release
+func (p *RuntimePool) Close() {
+	p.mu.Lock()
+	p.closed = true
+	p.mu.Unlock()
+
+	for {
+		select {
+		case w := <-p.workers:
+			w.close()
+		default:
+			return
+		}
+	}
+}
+
+// RenderStream acquires a runtime, streams the page to write and hands the runtime back
+func (p *RuntimePool) RenderStream(ctx context.Context, req RenderRequest, write func(chunk string) error) error {
+	w, err := p.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer p.Release(w)
+	return w.RenderStream(req, write)
+}
+
+// Render acquires a runtime, renders the page and hands the runtime back
+func (p *RuntimePool) Render(ctx context.Context, req RenderRequest) (string, error) {
+	w, err := p.Acquire(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer p.Release(w)
+	return w.Render(req)
+}
+
+func newWorker(p *RuntimePool, js string, sourceMap *SourceMap, gen uint64) *Worker {
+	w := &Worker{
+		pool:      p,
+		gen:       gen,
+		sourceMap: sourceMap,
+		jobs:      make(chan func()),
+		done:      make(chan struct{}),
+	}
+	ready := make(chan struct{})
+	go w.run(js, ready)
+	<-ready
+	return w
+}
+
+// run creates the runtime and serves jobs until the worker is closed.
+// quickjs.NewRuntime locks the goroutine to its OS thread
+func (w *Worker) run(js string, ready chan struct{}) {
+	defer close(w.done)
+
+	w.rt = quickjs.NewRuntime(quickjs.WithModuleImport(true))
+	w.ctx = w.rt.NewContext()
+	w.loadErr = w.load(js)
+	close(ready)
+
+	for job := range w.jobs {
+		job()
+	}
+
+	w.ctx.Close()
+	w.rt.Close()
+}
+
+// load evaluates the server bundle once so later renders can import it
+func (w *Worker) load(js string) error {
+	if js == "" {
+		return &RenderError{Message: "server bundle is empty"}
+	}
+	// Timers are run by await so their delays count against the render deadline
+	val, err := w.ctx.Eval(timers)
+	if err != nil {
+		return renderErrorFrom("", err)
+	}
+	val.Free()
+
+	module, err := w.ctx.LoadModule(js, "server")
+	if err != nil {
+		if exception := w.ctx.Exception(); exception != nil {
+			err = exception
+		}
+		return renderErrorFrom("", err)
+	}
+	defer module.Free()
+	if module.IsException() {
+		return renderErrorFrom("", w.ctx.Exception())
+	}
+
+	// __luna_write hands streamed chunks to the writer of the render in progress
+	w.ctx.Globals().Set("__luna_write", w.ctx.Function(func(ctx *quickjs.Context, this quickjs.Value, args []quickjs.Value) quickjs.Value {
+		if w.write == nil || len(args) == 0 {
+			return ctx.Undefined()
+		}
+		if err := w.write(args[0].String()); err != nil {
+			return ctx.ThrowError(err)
+		}
+		return ctx.Undefined()
+	}))
+
+	// The interrupt handler is polled by QuickJS while JS runs
+	w.ctx.SetInterruptHandler(func() int {
+		if !w.deadline.IsZero() && time.Now().After(w.deadline) {
+			w.interrupted = true
+			return 1
+		}
+		return 0
+	})
+
+	val, err = w.ctx.Eval(`
+      globalThis.URL = class {
+          constructor(url) {
+            this.href = url;
+          }
+        };`)
+	if err != nil {
+		return err
+	}
+	val.Free()
+	return nil
+}
+
+// do runs fn on the worker goroutine and waits for it to finish.
+// A panic in fn is returned as an error and retires the runtime
+func (w *Worker) do(fn func()) (err error) {
+	finished := make(chan struct{})
+	w.jobs <- func() {
+		defer close(finished)
+		defer func() {
+			if r := recover(); r != nil {
+				w.broken = true
+				err = fmt.Errorf("render panic: %v", r)
+			}
+		}()
+		fn()
+	}
+	<-finished
+	return err
+}
+
+func (w *Worker) close() {
+	close(w.jobs)
+	<-w.done
+}
+
+// Render calls the render function exported by the server bundle for the request path.
+// props and store are exposed to the bundle as globals for the duration of the render
+func (w *Worker) Render(req RenderRequest) (string, error) {
+	return w.eval(req, `
+              const { html } = server.render(path);
+              globalThis.result = html;`, nil)
+}
+
+// RenderStream calls the renderStream function exported by the server bundle for the request path,
+// passing every chunk it writes on to write. Bundles without renderStream are rendered
+// with render and written as a single chunk
+func (w *Worker) RenderStream(req RenderRequest, write func(chunk string) error) error {
+	_, err := w.eval(req, `
+              if (typeof server.renderStream === "function") {
+                  await server.renderStream(path, (chunk) => __luna_write(String(chunk)));
+              } else {
+                  const { html } = server.render(path);
+                  __luna_write(html);
+              }
+              globalThis.result = "";`, write)
+	return err
+}
+
+// eval sets up the page globals and runs body on the worker with the server
+// module bound to server and the requested path bound to path. It returns globalThis.result,
+// anything the bundle throws is returned as a *RenderError
+func (w *Worker) eval(req RenderRequest, body string, write func(chunk string) error) (string, error) {
+	if w.loadErr != nil {
+		return "", w.bundleError(req.Path)
+	}
+	props, store := req.Props, req.Store
+	if props == nil {
+		props = map[string]interface{}{}
+	}
+	if store == nil {
+		store = map[string]interface{}{}
+	}
+	jsonPath, err := json.Marshal(req.Path)
+	if err != nil {
+		return "", err
+	}
+	jsonProps, err := json.Marshal(props)
+	if err != nil {
+		return "", err
+	}
+	jsonStore, err := json.Marshal(store)
+	if err != nil {
+		return "", err
+	}
+
+	var result string
+	var renderErr *RenderError
+	doErr := w.do(func() {
+		w.write = write
+		w.applyLimits(req.Limits)
+		defer w.resetLimits(req.Limits)
+
+		script := fmt.Sprintf(`
+        globalThis.props = %s;
+        globalThis.store = %s;
+        globalThis.window = {
+          location: {
+            pathname: %s
+          }
+        };
+        globalThis.renderError = undefined;
+        globalThis.__luna_done = false;
+      async function start() {
+          try {
+              const path = %s;
+              const server = await import("server");%s
+          } catch (e) {
+              globalThis.renderError = { thrown: e };
+          } finally {
+              globalThis.__luna_done = true;
+          }
+      }
+      start();`, jsonProps, jsonStore, jsonPath, jsonPath, body)
+		val, evalErr := w.ctx.Eval(script)
+		if evalErr != nil {
+			renderErr = renderErrorFrom(req.Path, evalErr)
+			return
+		}
+		val.Free()
+		if renderErr = w.await(req.Path); renderErr != nil {
+			return
+		}
+
+		caught := w.ctx.Globals().Get("renderError")
+		defer caught.Free()
+		if !caught.IsUndefined() {
+			thrown := caught.Get("thrown")
+			defer thrown.Free()
+			renderErr = newRenderError(req.Path, thrown)
+			return
+		}
+
+		res := w.ctx.Globals().Get("result")
+		defer res.Free()
+		result = res.String()
+	})
+	if doErr != nil {
+		return "", doErr
+	}
+	if renderErr != nil {
+		w.sourceMap.MapError(renderErr)
+		if limitErr := w.limitError(req, renderErr); limitErr != nil {
+			return "", limitErr
+		}
+		return "", renderErr
+	}
+	return result, nil
+}
+
+// timers replaces the setTimeout of QuickJS, which blocks the event loop until the timer is due,
+// with a queue await runs between jobs. __luna_timers runs the first due timer and returns 0,
+// or the milliseconds until the next timer, or -1 when none is left
+const timers = `
+(() => {
+  let timers = new Map();
+  let nextId = 1;
+  globalThis.setTimeout = (fn, delay, ...args) => {
+    const id = nextId++;
+    timers.set(id, { fn, args, at: Date.now() + Math.max(0, Number(delay) || 0) });
+    return id;
+  };
+  globalThis.clearTimeout = (id) => {
+    timers.delete(id);
+  };
+  globalThis.__luna_timers = () => {
+    const now = Date.now();
+    let next = -1;
+    for (const [id, timer] of timers) {
+      if (timer.at <= now) {
+        timers.delete(id);
+        timer.fn(...timer.args);
+        return 0;
+      }
+      if (next < 0 || timer.at - now < next) {
+        next = timer.at - now;
+      }
+    }
+    return next;
+  };
+  globalThis.__luna_clearTimers = () => {
+    timers = new Map();
+  };
+})();`
+
+// await runs the jobs and timers queued by the render until start() finishes. QuickJS only
+// calls the interrupt handler while JS runs, so the deadline is also checked between jobs.
+// A render waiting on a promise nothing can settle fails right away
+func (w *Worker) await(path string) *RenderError {
+	defer func() {
+		// timers left by a finished render must not fire during the next one
+		if val, err := w.ctx.Eval("__luna_clearTimers()"); err == nil {
+			val.Free()
+		}
+	}()
+	interrupted := func() *RenderError {
+		w.interrupted = true
+		return &RenderError{Path: path, Name: "InternalError", Message: "interrupted"}
+	}
+	for {
+		w.ctx.Loop()
+		if w.interrupted {
+			return interrupted()
+		}
+		done := w.ctx.Globals().Get("__luna_done")
+		finished := done.Bool()
+		done.Free()
+		if finished {
+			return nil
+		}
+
+		next, err := w.ctx.Eval("__luna_timers()")
+		if err != nil {
+			if w.interrupted {
+				return interrupted()
+			}
+			return renderErrorFrom(path, err)
+		}
+		wait := time.Duration(next.Int64()) * time.Millisecond
+		next.Free()
+		switch {
+		case wait < 0 && !w.deadline.IsZero():
+			return interrupted()
+		case wait < 0:
+			return &RenderError{Path: path, Message: "render awaits a promise that is never settled"}
+		case !w.deadline.IsZero() && time.Now().Add(wait).After(w.deadline):
+			time.Sleep(time.Until(w.deadline))
+			return interrupted()
+		}
+		time.Sleep(wait)
+	}
+}
+
+// bundleError reports that the server bundle could not be loaded when rendering path
+func (w *Worker) bundleError(path string) error {
+	var renderErr *RenderError
+	if !errors.As(w.loadErr, &renderErr) {
+		return w.loadErr
+	}
+	loadErr := *renderErr
+	w.sourceMap.MapError(&loadErr)
+	loadErr.Path = path
+	loadErr.Message = "loading server bundle: " + loadErr.Message
+	return &loadErr
+}
+
+// applyLimits arms the limits of a render, the deadline starts once the runtime is acquired
+func (w *Worker) applyLimits(limits RenderLimits) {
+	w.interrupted = false
+	if limits.Timeout > 0 {
+		w.deadline = time.Now().Add(limits.Timeout)
+	}
+	if limits.MemoryLimit > 0 {
+		w.rt.SetMemoryLimit(limits.MemoryLimit)
+	}
+	if limits.MaxStackSize > 0 {
+		w.rt.SetMaxStackSize(limits.MaxStackSize)
+	}
+}
+
+// resetLimits lifts the limits again so they do not leak into the next render
+func (w *Worker) resetLimits(limits RenderLimits) {
+	w.write = nil
+	w.deadline = time.Time{}
+	if limits.MemoryLimit > 0 {
+		w.rt.SetMemoryLimit(math.MaxUint64)
+	}
+	if limits.MaxStackSize > 0 {
+		w.rt.SetMaxStackSize(defaultMaxStackSize)
+	}
+}
+
+// limitError reports which limit stopped a render, if any. The runtime is
+// retired after a limit is hit since the bundle state may be left half updated
+func (w *Worker) limitError(req RenderRequest, renderErr *RenderError) error {
+	var limit error
+	switch {
+	case w.interrupted:
+		limit = ErrRenderTimeout
+	case strings.Contains(renderErr.Message, "out of memory"),
+		// QuickJS throws null or an empty InternalError when it cannot allocate the error itself
+		req.Limits.MemoryLimit > 0 && renderErr.Name == "" && renderErr.Message == "null",
+		req.Limits.MemoryLimit > 0 && renderErr.Name == "InternalError" && renderErr.Message == "":
+		limit = ErrRenderMemory
+	case strings.Contains(renderErr.Message, "stack overflow"):
+		limit = ErrRenderStack
+	default:
+		return nil
+	}
+	w.broken = true
+	return &RenderLimitError{Path: req.Path, Limits: req.Limits, Err: limit}
+}
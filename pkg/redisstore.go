@@ -0,0 +1,459 @@
+package pkg
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RedisOptions configures a RedisStore
+type RedisOptions struct {
+	Addr        string        // host:port of a server speaking the Redis protocol
+	Password    string        // sent with AUTH when set
+	DB          int           // selected database
+	Prefix      string        // prefix of the keys and the invalidation channel, "luna:" by default
+	DialTimeout time.Duration // 5s by default
+	Timeout     time.Duration // deadline to send a command and read its reply, 5s by default
+	PoolSize    int           // idle connections kept open, 8 by default
+	MaxAge      time.Duration // how long a page without Expires is kept, IDs change with every build so older pages are never read again, 24h by default
+}
+
+// RedisStore is a CacheStore kept in Redis, or any server speaking its protocol, shared by every replica.
+// It is also a CacheBus that publishes invalidations on the "<prefix>invalidate" channel.
+// Pages expire in Redis once they can no longer be served. Their path, tags and size are kept
+// apart in the "<prefix>meta" hash, so invalidations and stats never read the pages themselves
+type RedisStore struct {
+	options RedisOptions
+	idle    chan *redisConn
+}
+
+// NewRedisStore creates a RedisStore, connections are opened on first use
+func NewRedisStore(options RedisOptions) *RedisStore {
+	if options.Prefix == "" {
+		options.Prefix = "luna:"
+	}
+	if options.DialTimeout == 0 {
+		options.DialTimeout = 5 * time.Second
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 5 * time.Second
+	}
+	if options.PoolSize == 0 {
+		options.PoolSize = 8
+	}
+	if options.MaxAge == 0 {
+		options.MaxAge = 24 * time.Hour
+	}
+	return &RedisStore{options: options, idle: make(chan *redisConn, options.PoolSize)}
+}
+
+func (s *RedisStore) key(id string) string {
+	return s.options.Prefix + "page:" + id
+}
+
+func (s *RedisStore) metaKey() string {
+	return s.options.Prefix + "meta"
+}
+
+func (s *RedisStore) channel() string {
+	return s.options.Prefix + "invalidate"
+}
+
+// do runs a command on a pooled connection. A connection that failed or timed out is closed instead of pooled
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	var conn *redisConn
+	select {
+	case conn = <-s.idle:
+	default:
+		var err error
+		if conn, err = s.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := conn.do(args...)
+	var replyErr redisError
+	if err != nil && !errors.As(err, &replyErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case s.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+// dial opens an authenticated connection to the selected database
+func (s *RedisStore) dial() (*redisConn, error) {
+	netConn, err := net.DialTimeout("tcp", s.options.Addr, s.options.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn), timeout: s.options.Timeout}
+	if s.options.Password != "" {
+		if _, err := conn.do("AUTH", s.options.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	if s.options.DB != 0 {
+		if _, err := conn.do("SELECT", strconv.Itoa(s.options.DB)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Get returns the entry with id
+func (s *RedisStore) Get(id string) (Cache, bool, error) {
+	reply, err := s.do("GET", s.key(id))
+	if err != nil || reply == nil {
+		return Cache{}, false, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return Cache{}, false, errUnexpectedReply
+	}
+	var cache Cache
+	if err := json.Unmarshal(data, &cache); err != nil {
+		return Cache{}, false, err
+	}
+	if cache.dead(time.Now()) {
+		return Cache{}, false, nil
+	}
+	return cache, true, nil
+}
+
+// redisMeta describes a page in the meta hash
+type redisMeta struct {
+	Cache    Cache     `json:"cache"` // the entry without Body and Page
+	Bytes    int64     `json:"bytes"`
+	Deadline time.Time `json:"deadline"` // when the page expires in Redis
+}
+
+// Set stores the entry until it can no longer be served, or for MaxAge when it never expires
+func (s *RedisStore) Set(cache Cache) error {
+	deadline := time.Now().Add(s.options.MaxAge)
+	if !cache.Expires.IsZero() {
+		deadline = cache.Expires.Add(cache.StaleIfError)
+	}
+	ttl := time.Until(deadline).Milliseconds()
+	if ttl <= 0 {
+		return nil
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	meta := redisMeta{Cache: cache, Bytes: cache.size(), Deadline: deadline}
+	meta.Cache.Body, meta.Cache.Page = "", nil
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := s.do("SET", s.key(cache.ID), string(data), "PX", strconv.FormatInt(ttl, 10)); err != nil {
+		return err
+	}
+	_, err = s.do("HSET", s.metaKey(), cache.ID, string(metaData))
+	return err
+}
+
+// Delete removes the entries match reports true for. match is called with the
+// entries without Body and Page
+func (s *RedisStore) Delete(match func(Cache) bool) (int, error) {
+	metas, err := s.metas()
+	if err != nil {
+		return 0, err
+	}
+	var keys, ids []string
+	for _, meta := range metas {
+		if match(meta.Cache) {
+			keys = append(keys, s.key(meta.Cache.ID))
+			ids = append(ids, meta.Cache.ID)
+		}
+	}
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	reply, err := s.do(append([]string{"DEL"}, keys...)...)
+	if err != nil {
+		return 0, err
+	}
+	removed, ok := reply.(int64)
+	if !ok {
+		return 0, errUnexpectedReply
+	}
+	if _, err := s.do(append([]string{"HDEL", s.metaKey()}, ids...)...); err != nil {
+		return int(removed), err
+	}
+	return int(removed), nil
+}
+
+// Entries returns every entry without its Body and Page
+func (s *RedisStore) Entries() ([]Cache, error) {
+	metas, err := s.metas()
+	var entries []Cache
+	for _, meta := range metas {
+		meta.Cache.bytes = meta.Bytes
+		entries = append(entries, meta.Cache)
+	}
+	return entries, err
+}
+
+// Stats returns the number and size of the entries
+func (s *RedisStore) Stats() (CacheStats, error) {
+	metas, err := s.metas()
+	stats := CacheStats{Entries: len(metas)}
+	for _, meta := range metas {
+		stats.Bytes += meta.Bytes
+	}
+	return stats, err
+}
+
+// DeleteExpired removes the meta of the pages Redis expired
+func (s *RedisStore) DeleteExpired() error {
+	now := time.Now()
+	reply, err := s.do("HGETALL", s.metaKey())
+	if err != nil {
+		return err
+	}
+	var expired []string
+	err = eachMeta(reply, func(id string, meta redisMeta) {
+		if !now.Before(meta.Deadline) {
+			expired = append(expired, id)
+		}
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+	_, err = s.do(append([]string{"HDEL", s.metaKey()}, expired...)...)
+	return err
+}
+
+// metas returns the meta of the pages that did not expire yet
+func (s *RedisStore) metas() ([]redisMeta, error) {
+	now := time.Now()
+	reply, err := s.do("HGETALL", s.metaKey())
+	if err != nil {
+		return nil, err
+	}
+	var metas []redisMeta
+	err = eachMeta(reply, func(_ string, meta redisMeta) {
+		if now.Before(meta.Deadline) {
+			metas = append(metas, meta)
+		}
+	})
+	return metas, err
+}
+
+// eachMeta calls fn with every field of a HGETALL reply of the meta hash
+func eachMeta(reply interface{}, fn func(id string, meta redisMeta)) error {
+	fields, ok := reply.([]interface{})
+	if !ok || len(fields)%2 != 0 {
+		return errUnexpectedReply
+	}
+	for i := 0; i < len(fields); i += 2 {
+		id, _ := fields[i].([]byte)
+		data, ok := fields[i+1].([]byte)
+		if !ok {
+			return errUnexpectedReply
+		}
+		var meta redisMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return err
+		}
+		fn(string(id), meta)
+	}
+	return nil
+}
+
+// Publish sends an invalidation to the subscribed replicas
+func (s *RedisStore) Publish(invalidation Invalidation) error {
+	data, err := json.Marshal(invalidation)
+	if err != nil {
+		return err
+	}
+	_, err = s.do("PUBLISH", s.channel(), string(data))
+	return err
+}
+
+// Subscribe calls handle with every invalidation published on the channel until stop is called.
+// A lost connection is opened again after a second, invalidations published meanwhile are missed.
+// When the first connection fails the error is returned and the subscription keeps retrying
+func (s *RedisStore) Subscribe(handle func(Invalidation)) (func(), error) {
+	var (
+		mu      sync.Mutex
+		current *redisConn // closed by stop to end a blocking read
+		stopped bool
+		done    = make(chan struct{})
+	)
+	connect := func() (*redisConn, error) {
+		conn, err := s.dial()
+		if err != nil {
+			return nil, err
+		}
+		// only the handshake has a deadline, messages arrive whenever a replica publishes
+		if _, err := conn.do("SUBSCRIBE", s.channel()); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := conn.SetDeadline(time.Time{}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			conn.Close()
+			return nil, net.ErrClosed
+		}
+		current = conn
+		return conn, nil
+	}
+	conn, err := connect()
+
+	go func() {
+		for {
+			if conn != nil {
+				for {
+					reply, err := conn.read()
+					if err != nil {
+						break
+					}
+					message, ok := reply.([]interface{})
+					if !ok || len(message) != 3 {
+						continue
+					}
+					kind, _ := message[0].([]byte)
+					payload, _ := message[2].([]byte)
+					var invalidation Invalidation
+					if string(kind) == "message" && json.Unmarshal(payload, &invalidation) == nil {
+						handle(invalidation)
+					}
+				}
+				conn.Close()
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(time.Second):
+			}
+			conn, _ = connect()
+		}
+	}()
+
+	stop := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		if stopped {
+			return
+		}
+		stopped = true
+		close(done)
+		if current != nil {
+			current.Close()
+		}
+	}
+	return stop, err
+}
+
+// Close closes the idle connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case conn := <-s.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+var errUnexpectedReply = errors.New("redis: unexpected reply")
+
+// redisError is an error reply of the server
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn speaks RESP, the Redis serialization protocol
+type redisConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// do sends a command and reads its reply within the timeout, a stalled server fails the command
+func (c *redisConn) do(args ...string) (interface{}, error) {
+	if err := c.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if err := c.write(args...); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// write sends a command as an array of bulk strings
+func (c *redisConn) write(args ...string) error {
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, arg := range args {
+		buf = fmt.Appendf(buf, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	_, err := c.Write(buf)
+	return err
+}
+
+// read returns a reply as a string, an int64, a []byte, a []interface{} or nil.
+// An error reply is returned as a redisError
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errors.New("redis: malformed reply")
+	}
+	kind, rest := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return rest, nil
+	case '-':
+		return nil, redisError(rest)
+	case ':':
+		return strconv.ParseInt(rest, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(rest)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		size, err := strconv.Atoi(rest)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, size)
+		for i := range items {
+			if items[i], err = c.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+}
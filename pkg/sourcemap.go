@@ -0,0 +1,102 @@
+package pkg
+
+import (
+	"encoding/json"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strconv"
+
+	"github.com/go-sourcemap/sourcemap"
+)
+
+// SourceMap translates positions in the server bundle back to the original sources
+type SourceMap struct {
+	consumer *sourcemap.Consumer
+	contents map[string]string // original sources keyed by their normalized path
+}
+
+// bundleFrame matches a stack frame location inside the server bundle, e.g. "(server:12)" or "(server:12:5)"
+var bundleFrame = regexp.MustCompile(`\(server:(\d+)(?::(\d+))?\)`)
+
+// ParseSourceMap parses the source map esbuild wrote next to the server bundle
+func ParseSourceMap(data string) (*SourceMap, error) {
+	consumer, err := sourcemap.Parse("", []byte(data))
+	if err != nil {
+		return nil, err
+	}
+	var sources struct {
+		Sources        []string `json:"sources"`
+		SourcesContent []string `json:"sourcesContent"`
+	}
+	if err := json.Unmarshal([]byte(data), &sources); err != nil {
+		return nil, err
+	}
+	m := &SourceMap{consumer: consumer, contents: make(map[string]string)}
+	for i, source := range sources.Sources {
+		if i < len(sources.SourcesContent) {
+			m.contents[m.normalize(source)] = sources.SourcesContent[i]
+		}
+	}
+	return m, nil
+}
+
+// normalize converts a source listed in the map to a path relative to the working directory.
+// esbuild writes sources relative to the output directory, which is the root
+func (m *SourceMap) normalize(source string) string {
+	return sourcePath(filepath.Join("/", source))
+}
+
+// Source returns the original file, line and column for a position in the bundle.
+// QuickJS stack frames only carry a line, a zero column matches the last mapping on that line
+// and the original column is reported as 0, unknown
+func (m *SourceMap) Source(line, column int) (file string, srcLine, srcColumn int, ok bool) {
+	if m == nil {
+		return "", 0, 0, false
+	}
+	lookup := column
+	if column == 0 {
+		lookup = math.MaxInt32
+	}
+	source, _, srcLine, srcColumn, ok := m.consumer.Source(line, lookup)
+	if !ok || source == "" {
+		return "", 0, 0, false
+	}
+	if column == 0 {
+		srcColumn = 0
+	}
+	return m.normalize(source), srcLine, srcColumn, true
+}
+
+// SourceContent returns the original content of a file listed in the source map
+func (m *SourceMap) SourceContent(file string) string {
+	if m == nil {
+		return ""
+	}
+	return m.contents[sourcePath(file)]
+}
+
+// MapError rewrites the stack and location of a render error to the original sources
+func (m *SourceMap) MapError(err *RenderError) {
+	if m == nil || err == nil {
+		return
+	}
+	err.Stack = bundleFrame.ReplaceAllStringFunc(err.Stack, func(frame string) string {
+		match := bundleFrame.FindStringSubmatch(frame)
+		line, _ := strconv.Atoi(match[1])
+		column, _ := strconv.Atoi(match[2])
+		file, srcLine, srcColumn, ok := m.Source(line, column)
+		if !ok {
+			return frame
+		}
+		if srcColumn == 0 {
+			return "(" + file + ":" + strconv.Itoa(srcLine) + ")"
+		}
+		return "(" + file + ":" + strconv.Itoa(srcLine) + ":" + strconv.Itoa(srcColumn) + ")"
+	})
+	if err.File == "server" {
+		if file, line, column, ok := m.Source(err.Line, err.Column); ok {
+			err.File, err.Line, err.Column = file, line, column
+		}
+	}
+}
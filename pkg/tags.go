@@ -0,0 +1,28 @@
+package pkg
+
+import (
+	"slices"
+
+	"github.com/labstack/echo/v4"
+)
+
+// cacheTagsKey is the echo.Context key CacheTag collects the tags of a render under
+const cacheTagsKey = "luna.cacheTags"
+
+// CacheTag attaches tags to the page rendered for c, such as "deck:42" for the deck it shows.
+// Call it from Props, Engine.InvalidateTags evicts the cached page by any of them
+func CacheTag(c echo.Context, tags ...string) {
+	current, _ := c.Get(cacheTagsKey).([]string)
+	for _, tag := range tags {
+		if !slices.Contains(current, tag) {
+			current = append(current, tag)
+		}
+	}
+	c.Set(cacheTagsKey, current)
+}
+
+// CacheTags returns the tags attached to c with CacheTag
+func CacheTags(c echo.Context) []string {
+	tags, _ := c.Get(cacheTagsKey).([]string)
+	return tags
+}
@@ -2,16 +2,46 @@ package pkg
 
 import (
 	"html/template"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
 
+// SSRFallback decides what a route serves when its server render fails or times out
+type SSRFallback int
+
+const (
+	SSRFallbackFail       SSRFallback = iota // return the render error
+	SSRFallbackClientOnly                    // serve the page shell with an empty root and render on the client
+	SSRFallbackLastGood                      // serve the last successful render of the path, client-only if there is none
+)
+
+func (f SSRFallback) String() string {
+	switch f {
+	case SSRFallbackClientOnly:
+		return "client-only"
+	case SSRFallbackLastGood:
+		return "last-good"
+	default:
+		return "fail"
+	}
+}
+
 type ReactRoute struct {
-	Path        string
-	CacheExpiry int64
-	Head        Head
-	Props       func(c echo.Context, params map[string]string) map[string]interface{}
-	Middleware  []echo.MiddlewareFunc
+	Path         string
+	Component    string        // source file of the page component, used to preload the chunks it needs
+	CachePolicy  CachePolicy   // relative lifetime of cached pages
+	CacheExpiry  int64         // Deprecated: Unix time the cached pages expire at, use CachePolicy
+	Revalidate   time.Duration // Deprecated: age after which the cached page is rendered again in the background while it keeps being served, use CachePolicy
+	CacheTags    []string      // tags of every cached page of the route, pkg.CacheTag adds tags to a single render
+	CacheVary    CacheVary     // what the cached page depends on besides the path
+	Stream       bool          // flush the document head first and stream the rendered body
+	RenderLimits *RenderLimits // overrides the non-zero limits of Config.RenderLimits
+	SSRFallback  SSRFallback   // what to serve when the server render fails, streamed routes always fail
+	Head         Head
+	Props        func(c echo.Context, params map[string]string) map[string]interface{}
+	StaticPaths  func() []string // paths Engine.Export renders for a parameterised route
+	Middleware   []echo.MiddlewareFunc
 }
 type Store func(c echo.Context) map[string]interface{}
 
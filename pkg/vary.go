@@ -0,0 +1,87 @@
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// CacheVary lists what the cached page of a route depends on besides its path.
+// Background renders replay the query, headers and cookies of the cached request,
+// a Custom key should be derived from those
+type CacheVary struct {
+	Query       []string                    // query parameters, "*" varies on the whole query
+	Headers     []string                    // request headers such as Accept-Language
+	Cookies     []string                    // cookie names
+	Custom      func(c echo.Context) string // extra part of the key
+	SharedStore bool                        // cache the page although Config.Store is set, the store must not differ between requests of one key
+}
+
+// Vary returns the query parameters and headers of r the page depends on, varied cookies are set as a Cookie header
+func (v CacheVary) Vary(r *http.Request) (url.Values, http.Header) {
+	query := url.Values{}
+	all := r.URL.Query()
+	for _, name := range v.Query {
+		if name == "*" {
+			query = all
+			break
+		}
+		if values, ok := all[name]; ok {
+			query[name] = values
+		}
+	}
+
+	header := http.Header{}
+	for _, name := range v.Headers {
+		if values := r.Header.Values(name); len(values) > 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+	var cookies []string
+	for _, name := range v.Cookies {
+		if cookie, err := r.Cookie(name); err == nil {
+			cookies = append(cookies, cookie.String())
+		}
+	}
+	if len(cookies) > 0 {
+		header.Set("Cookie", strings.Join(cookies, "; "))
+	}
+	return query, header
+}
+
+// CacheKey returns the key the page at path is cached under for the request of c.
+// The varied values are hashed, so cookies and headers never show in a key
+func (v CacheVary) CacheKey(c echo.Context, path string) string {
+	query, header := v.Vary(c.Request())
+	parts := url.Values{}
+	for name, values := range query {
+		parts["q:"+name] = values
+	}
+	for name, values := range header {
+		parts["h:"+name] = values
+	}
+	if v.Custom != nil {
+		parts.Set("k", v.Custom(c))
+	}
+	if len(parts) == 0 {
+		return path
+	}
+	sum := sha256.Sum256([]byte(parts.Encode()))
+	return path + "?" + hex.EncodeToString(sum[:16])
+}
+
+// Header returns the Vary response header for the headers and cookies the page depends on
+func (v CacheVary) Header() string {
+	names := make([]string, 0, len(v.Headers)+1)
+	for _, name := range v.Headers {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+	if len(v.Cookies) > 0 {
+		names = append(names, "Cookie")
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,124 @@
+package luna
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+// revalidateKey carries the cache ID a background render replaces, such requests skip the cache
+type revalidateKey struct{}
+
+// Revalidate renders the cached pages of paths, every variant of them, again in the background.
+// The cached pages keep being served until the new render replaces them, paths that are not cached are ignored
+func (e *Engine) Revalidate(paths ...string) {
+	e.revalidateEntries(func(cache pkg.Cache) bool {
+		return slices.Contains(paths, cache.Path)
+	})
+}
+
+// RevalidateTag renders the cached pages carrying one of tags again in the background
+func (e *Engine) RevalidateTag(tags ...string) {
+	e.revalidateEntries(func(cache pkg.Cache) bool {
+		return slices.ContainsFunc(cache.Tags, func(tag string) bool { return slices.Contains(tags, tag) })
+	})
+}
+
+// revalidateEntries replays the entries match reports true for. An entry whose credentials
+// were not stored cannot be replayed, every page of its path is purged instead
+func (e *Engine) revalidateEntries(match func(pkg.Cache) bool) {
+	current := e.frontend.Load()
+	if current == nil {
+		return
+	}
+	var purge []string
+	for _, cache := range current.cache.Entries(match) {
+		if cache.CredentialsDropped {
+			purge = append(purge, cache.Path)
+			continue
+		}
+		e.revalidate(cache, cache.Header)
+	}
+	if len(purge) > 0 {
+		current.cache.Invalidate(pkg.Invalidation{Paths: purge})
+	}
+}
+
+// revalidate starts a background render of a cached page unless one is already running.
+// The request replays the varied query of the page and header and goes through the server,
+// middleware included. The new page replaces the entry once it rendered, a failed render keeps it
+func (e *Engine) revalidate(cache pkg.Cache, header http.Header) {
+	if _, running := e.revalidating.LoadOrStore(cache.ID, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer e.revalidating.Delete(cache.ID)
+		defer func() {
+			if r := recover(); r != nil {
+				e.Logger.Error().Str("path", cache.Path).Msgf("Revalidating cached page panicked, keeping the stale page: %v", r)
+			}
+		}()
+
+		ctx := context.WithValue(context.Background(), revalidateKey{}, cache.ID)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, cache.URL, nil)
+		if err != nil {
+			e.Logger.Error().Err(err).Str("path", cache.Path).Msg("Revalidating cached page failed, keeping the stale page")
+			return
+		}
+		if header != nil {
+			req.Header = header.Clone()
+		}
+		res := newResponseBuffer()
+		e.Server.ServeHTTP(res, req)
+		if res.status != http.StatusOK {
+			e.Logger.Error().Str("path", cache.Path).Int("status", res.status).Msg("Revalidating cached page failed, keeping the stale page")
+		}
+	}()
+}
+
+// responseBuffer is the ResponseWriter of renders the engine requests from itself
+type responseBuffer struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newResponseBuffer() *responseBuffer {
+	return &responseBuffer{header: http.Header{}}
+}
+
+func (r *responseBuffer) Header() http.Header {
+	return r.header
+}
+
+func (r *responseBuffer) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseBuffer) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
+
+// Flush lets streamed pages render into the buffer
+func (r *responseBuffer) Flush() {}
+
+// setCacheHeaders tells downstream caches how long they may keep a page of a route with a CachePolicy
+func setCacheHeaders(c echo.Context, route pkg.ReactRoute, renderedAt time.Time) {
+	if route.CachePolicy.TTL <= 0 {
+		return
+	}
+	header := c.Response().Header()
+	// A custom key cannot be expressed with Vary, so only the browser may keep the page
+	header.Set(echo.HeaderCacheControl, route.CachePolicy.CacheControl(time.Since(renderedAt), route.CacheVary.Custom != nil))
+	if vary := route.CacheVary.Header(); vary != "" {
+		header.Add(echo.HeaderVary, vary)
+	}
+}
@@ -0,0 +1,47 @@
+package luna
+
+import (
+	"html/template"
+	"net/http"
+
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+)
+
+// streamPage flushes the document head right away and streams the body
+// chunks as the server bundle produces them
+func (e *Engine) streamPage(c echo.Context, tmpl *template.Template, data pkg.CreateTemplateData, req pkg.RenderRequest) error {
+	head, tail, err := pkg.SplitTemplate(tmpl, data)
+	if err != nil {
+		e.Logger.Error().Msgf("Template loading error: %s", err)
+		return c.String(http.StatusInternalServerError, "Error loading template")
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, echo.MIMETextHTMLCharsetUTF8)
+	res.WriteHeader(http.StatusOK)
+	if _, err := res.Write(head); err != nil {
+		return err
+	}
+	res.Flush()
+
+	err = e.renderer.RenderStream(c.Request().Context(), req, func(chunk string) error {
+		if _, err := res.Write([]byte(chunk)); err != nil {
+			return err
+		}
+		res.Flush()
+		return nil
+	})
+	if _, writeErr := res.Write(tail); writeErr != nil && err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		// The status line is already sent, the client renders the page from scratch.
+		// Echo's error handler skips committed responses but middleware still sees the error
+		e.Logger.Error().Err(err).Msg("Error streaming server HTML")
+		if e.HotReload != nil {
+			e.HotReload.send(c.Request().URL.Path, hotMessage{Type: hotError, Errors: e.HotReload.renderErrors(err)})
+		}
+	}
+	return err
+}
@@ -0,0 +1,8 @@
+import "./test.css";
+import { mount } from "./shared.js";
+
+const pages = {
+  "/": () => import("./pages/home.js"),
+};
+
+pages[window.location.pathname]?.().then((page) => mount(page.default));
@@ -0,0 +1,36 @@
+function deep(n) {
+  return deep(n + 1) + 1;
+}
+
+function fail() {
+  throw new TypeError("boom");
+}
+
+export function render(path) {
+  if (path === "/throw") {
+    fail();
+  }
+  if (path === "/loop") {
+    for (;;) {}
+  }
+  if (path === "/alloc") {
+    const items = [];
+    for (;;) items.push("luna".repeat(64) + items.length);
+  }
+  if (path === "/deep") {
+    deep(0);
+  }
+  if (props.fail) {
+    throw new Error("flaky");
+  }
+  return { html: `<h1>${path}</h1><p>${props.name || ""}</p><p>${store.user || ""}</p>` };
+}
+
+export async function renderStream(path, write) {
+  write(`<h1>${path}</h1>`);
+  if (path === "/pending") await new Promise(() => {});
+  if (path === "/sleep") await new Promise((resolve) => setTimeout(resolve, 10000));
+  if (path === "/tick") await new Promise((resolve) => setTimeout(resolve, 10));
+  await Promise.resolve();
+  write(`<p>${props.name || ""}</p>`);
+}
@@ -0,0 +1,5 @@
+import { mount } from "../shared.js";
+
+export default function home() {
+  return typeof mount + window.location.pathname;
+}
@@ -0,0 +1,3 @@
+export function mount(page) {
+  document.getElementById("root").dataset.path = page();
+}
@@ -0,0 +1,225 @@
+package luna
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Djancyp/luna"
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheManager(t *testing.T) {
+	store := pkg.NewMemoryStore(2, 0)
+	m := pkg.NewManager(pkg.CacheOptions{Store: store, SweepInterval: -1})
+	defer m.Close()
+
+	m.AddCache(pkg.Cache{ID: "/a", Path: "/a", Page: []byte("a1")})
+	m.AddCache(pkg.Cache{ID: "/a", Path: "/a", Page: []byte("a2")})
+	assert.Equal(t, 1, m.Stats().Entries)
+	cached, found := m.GetCache("/a")
+	assert.True(t, found)
+	assert.Equal(t, "a2", string(cached.Page))
+
+	// /a was used last, so /b is evicted
+	m.AddCache(pkg.Cache{ID: "/b", Path: "/b"})
+	m.GetCache("/a")
+	m.AddCache(pkg.Cache{ID: "/c", Path: "/c"})
+	_, found = m.GetCache("/b")
+	assert.False(t, found)
+	_, found = m.GetCache("/a")
+	assert.True(t, found)
+
+	m.AddCache(pkg.Cache{ID: "/old", Path: "/old", Expires: time.Now().Add(-time.Second)})
+	assert.NoError(t, store.DeleteExpired())
+	stats := m.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(3), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	assert.Equal(t, int64(2), stats.Evictions)
+
+	budget := pkg.NewManager(pkg.CacheOptions{MaxBytes: 10, SweepInterval: -1})
+	defer budget.Close()
+	budget.AddCache(pkg.Cache{ID: "1", Page: []byte("12345")})
+	budget.AddCache(pkg.Cache{ID: "2", Page: []byte("12345")})
+	budget.AddCache(pkg.Cache{ID: "3", Page: []byte("too large for the budget")})
+	assert.Equal(t, 1, budget.Stats().Entries)
+	assert.Equal(t, int64(6), budget.Stats().Bytes)
+	_, found = budget.GetCache("2")
+	assert.True(t, found)
+}
+
+func TestCacheVary(t *testing.T) {
+	var renders atomic.Int32
+	props := func(c echo.Context, _ map[string]string) map[string]interface{} {
+		return map[string]interface{}{"name": fmt.Sprintf("%d %s %s", renders.Add(1), c.QueryParam("page"), c.Request().Header.Get("Accept-Language"))}
+	}
+	app := newTestEngine(t, pkg.ReactRoute{
+		Path:        "/list",
+		CacheExpiry: time.Now().Add(time.Hour).Unix(),
+		CacheVary:   pkg.CacheVary{Query: []string{"page"}, Headers: []string{"Accept-Language"}},
+		Props:       props,
+	})
+	get := func(target, language string) string {
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Header.Set("Accept-Language", language)
+		rec := httptest.NewRecorder()
+		app.Server.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+
+	assert.Contains(t, get("/list?page=1", "en"), "<p>1 1 en</p>")
+	assert.Contains(t, get("/list?page=2", "en"), "<p>2 2 en</p>")
+	assert.Contains(t, get("/list?page=1", "de"), "<p>3 1 de</p>")
+	// parameters the route does not vary on share the page
+	assert.Contains(t, get("/list?page=1&utm=x", "en"), "<p>1 1 en</p>")
+
+	app.Revalidate("/list")
+	assert.Eventually(t, func() bool {
+		return strings.Contains(get("/list?page=2", "en"), "2 en</p>") && !strings.Contains(get("/list?page=2", "en"), "<p>2 2 en</p>")
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheSkipsPerRequestStore(t *testing.T) {
+	for _, shared := range []bool{false, true} {
+		// without SharedStore the route is not cached although it does not vary on the user
+		vary := pkg.CacheVary{SharedStore: shared}
+		if shared {
+			vary.Headers = []string{"X-User"}
+		}
+		app := newEngine(t, func(config *luna.Config) {
+			config.Store = func(c echo.Context) map[string]interface{} {
+				return map[string]interface{}{"user": c.Request().Header.Get("X-User")}
+			}
+			config.Routes = []pkg.ReactRoute{{
+				Path:        "/",
+				CacheExpiry: time.Now().Add(time.Hour).Unix(),
+				CacheVary:   vary,
+			}}
+		})
+
+		for _, user := range []string{"ada", "bob"} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-User", user)
+			rec := httptest.NewRecorder()
+			app.Server.ServeHTTP(rec, req)
+			assert.Contains(t, rec.Body.String(), "<p>"+user+"</p>")
+		}
+	}
+}
+
+func TestCachePolicy(t *testing.T) {
+	var renders atomic.Int32
+	var fail atomic.Bool
+	props := func(_ echo.Context, _ map[string]string) map[string]interface{} {
+		return map[string]interface{}{"name": fmt.Sprintf("render %d", renders.Add(1)), "fail": fail.Load()}
+	}
+	app := newTestEngine(t,
+		pkg.ReactRoute{
+			Path:        "/feed",
+			CachePolicy: pkg.CachePolicy{TTL: 5 * time.Minute, StaleWhileRevalidate: time.Hour, StaleIfError: 24 * time.Hour},
+			CacheVary:   pkg.CacheVary{Headers: []string{"accept-language"}},
+			Props:       props,
+		},
+		pkg.ReactRoute{
+			Path:        "/status",
+			CachePolicy: pkg.CachePolicy{TTL: 50 * time.Millisecond, StaleIfError: time.Hour},
+			Props:       props,
+		},
+	)
+
+	rec := serve(app, http.MethodGet, "/feed")
+	assert.Equal(t, "public, max-age=300, stale-while-revalidate=3600, stale-if-error=86400", rec.Header().Get(echo.HeaderCacheControl))
+	assert.Contains(t, rec.Header().Values(echo.HeaderVary), "Accept-Language")
+
+	assert.Contains(t, serve(app, http.MethodGet, "/status").Body.String(), "<p>render 2</p>")
+	time.Sleep(60 * time.Millisecond)
+	// the page expired without a stale-while-revalidate window, so it renders again
+	assert.Contains(t, serve(app, http.MethodGet, "/status").Body.String(), "<p>render 3</p>")
+
+	time.Sleep(60 * time.Millisecond)
+	fail.Store(true)
+	rec = serve(app, http.MethodGet, "/status")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<p>render 3</p>")
+	assert.Equal(t, "public, max-age=0, stale-if-error=3600", rec.Header().Get(echo.HeaderCacheControl))
+}
+
+func TestCachePurge(t *testing.T) {
+	policy := pkg.CachePolicy{TTL: time.Hour}
+	app := newTestEngine(t,
+		pkg.ReactRoute{Path: "/", CachePolicy: policy},
+		pkg.ReactRoute{Path: "/decks/:id", CachePolicy: policy, CacheTags: []string{"decks"}},
+		pkg.ReactRoute{Path: "/about", CachePolicy: policy},
+	)
+	warm := func() {
+		for _, path := range []string{"/", "/decks/1", "/decks/2", "/about"} {
+			serve(app, http.MethodGet, path)
+		}
+	}
+	warm()
+	assert.Equal(t, 4, app.CacheStats().Entries)
+	assert.Equal(t, "/", app.CacheEntries()[0].Path)
+
+	assert.Equal(t, 1, app.Purge("/about"))
+	assert.Equal(t, 2, app.PurgeRoute("/decks/:id"))
+	assert.Equal(t, 1, app.PurgeAll())
+	warm()
+	assert.Equal(t, 2, app.InvalidateTags("decks"))
+
+	app.CacheAdmin("/admin/cache", func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Request().Header.Get("Authorization") != "secret" {
+				return echo.ErrUnauthorized
+			}
+			return next(c)
+		}
+	})
+	admin := func(method, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Authorization", "secret")
+		rec := httptest.NewRecorder()
+		app.Server.ServeHTTP(rec, req)
+		return rec
+	}
+	assert.Equal(t, http.StatusUnauthorized, serve(app, http.MethodGet, "/admin/cache/stats").Code)
+	assert.Contains(t, admin(http.MethodGet, "/admin/cache/stats").Body.String(), `"entries":2`)
+	assert.Contains(t, admin(http.MethodGet, "/admin/cache/entries").Body.String(), `"path":"/about"`)
+	assert.Equal(t, http.StatusBadRequest, admin(http.MethodDelete, "/admin/cache/entries").Code)
+	assert.JSONEq(t, `{"purged":2}`, admin(http.MethodDelete, "/admin/cache/entries?path=/&path=/about").Body.String())
+}
+
+func TestInvalidateTags(t *testing.T) {
+	decks := map[string]string{"1": "Go", "2": "React"}
+	var mu sync.Mutex
+	policy := pkg.CachePolicy{TTL: time.Hour}
+	deckProps := func(c echo.Context, params map[string]string) map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		pkg.CacheTag(c, "deck:"+params["id"])
+		return map[string]interface{}{"name": decks[params["id"]]}
+	}
+	app := newTestEngine(t,
+		pkg.ReactRoute{Path: "/decks/:id", CachePolicy: policy, Props: deckProps},
+		pkg.ReactRoute{Path: "/decks/:id/play", CachePolicy: policy, Props: deckProps},
+	)
+	for _, path := range []string{"/decks/1", "/decks/1/play", "/decks/2"} {
+		serve(app, http.MethodGet, path)
+	}
+
+	mu.Lock()
+	decks["1"] = "Golang"
+	mu.Unlock()
+	assert.Contains(t, serve(app, http.MethodGet, "/decks/1").Body.String(), "<p>Go</p>")
+	assert.Equal(t, 2, app.InvalidateTags("deck:1"))
+	assert.Contains(t, serve(app, http.MethodGet, "/decks/1").Body.String(), "<p>Golang</p>")
+	assert.Contains(t, serve(app, http.MethodGet, "/decks/1/play").Body.String(), "<p>Golang</p>")
+	assert.Contains(t, serve(app, http.MethodGet, "/decks/2").Body.String(), "<p>React</p>")
+}
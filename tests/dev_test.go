@@ -0,0 +1,141 @@
+package luna
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Djancyp/luna"
+	"github.com/Djancyp/luna/pkg"
+	"github.com/gorilla/websocket"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchGlob(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"**/node_modules/**", "node_modules", true},
+		{"**/node_modules/**", "app/node_modules/react/index.js", true},
+		{"**/*.swp", "src/.App.tsx.swp", true},
+		{"src/**/*.tsx", "src/App.tsx", true},
+		{"src/**/*.tsx", "src/pages/home/Home.tsx", true},
+		{"src/**/*.tsx", "src/App.css", false},
+		{"src/*.tsx", "src/pages/Home.tsx", false},
+		{"**", "anything/at/all", true},
+	}
+	for _, tc := range cases {
+		assert.Equal(t, tc.want, pkg.MatchGlob(tc.pattern, tc.name), "%s %s", tc.pattern, tc.name)
+	}
+}
+
+func TestHotReloadWebsocket(t *testing.T) {
+	app := newEngine(t, func(config *luna.Config) {
+		config.ENV = "development"
+		config.RootPath = t.TempDir()
+		config.Routes = []pkg.ReactRoute{{Path: "/"}}
+	})
+
+	// the page points at the websocket of the host and scheme the browser used
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "example.com"
+	req.Header.Set(echo.HeaderXForwardedProto, "https")
+	rec := httptest.NewRecorder()
+	app.Server.ServeHTTP(rec, req)
+	assert.Contains(t, rec.Body.String(), `wss:\/\/example.com\/_luna\/ws`)
+
+	server := httptest.NewServer(app.Server)
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/_luna/ws", nil)
+	if assert.NoError(t, err) {
+		defer ws.Close()
+		assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte("/")))
+		var message map[string]interface{}
+		assert.NoError(t, ws.ReadJSON(&message))
+		assert.Equal(t, "connected", message["type"])
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	root := t.TempDir()
+	app := newEngine(t, func(config *luna.Config) {
+		config.ENV = "development"
+		config.RootPath = root
+		config.WatchDebounce = 100 * time.Millisecond
+		config.Routes = []pkg.ReactRoute{{Path: "/"}}
+	})
+
+	server := httptest.NewServer(app.Server)
+	defer server.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/_luna/ws", nil)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+	assert.NoError(t, ws.WriteMessage(websocket.TextMessage, []byte("/")))
+
+	// every rebuild is broadcast to the page
+	messages := make(chan struct{}, 16)
+	go func() {
+		defer close(messages)
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				return
+			}
+			messages <- struct{}{}
+		}
+	}()
+	rebuilds := func(wait time.Duration) int {
+		n := 0
+		timeout := time.After(wait)
+		for {
+			select {
+			case _, ok := <-messages:
+				if !ok {
+					return n
+				}
+				n++
+			case <-timeout:
+				return n
+			}
+		}
+	}
+	write := func(name string) {
+		file := filepath.Join(root, name)
+		assert.NoError(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.NoError(t, os.WriteFile(file, []byte(name), 0644))
+	}
+	<-messages // connected
+
+	// the watcher starts in the background, wait until it sees changes
+	for i := 0; i < 10; i++ {
+		write("ready.txt")
+		if rebuilds(500*time.Millisecond) > 0 {
+			break
+		}
+	}
+	rebuilds(300 * time.Millisecond)
+
+	// a burst of changes in a new directory rebuilds once
+	for _, name := range []string{"src/a.js", "src/b.js", "src/c.js"} {
+		write(name)
+		time.Sleep(20 * time.Millisecond)
+	}
+	assert.Equal(t, 1, rebuilds(600*time.Millisecond))
+
+	// the new directory is watched
+	write("src/d.js")
+	assert.Equal(t, 1, rebuilds(600*time.Millisecond))
+
+	// dependencies and editor files are ignored
+	write("node_modules/react/index.js")
+	write("src/.d.js.swp")
+	write("src/d.js~")
+	assert.Equal(t, 0, rebuilds(600*time.Millisecond))
+}
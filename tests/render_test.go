@@ -0,0 +1,594 @@
+package luna
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/Djancyp/luna"
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func buildTestServer(t *testing.T) (string, *pkg.SourceMap) {
+	job := pkg.JobRunner{ServerEntryPoint: "./assets/entry-server.js"}
+	server, err := job.BuildServer()
+	assert.NoError(t, err)
+	sourceMap, err := pkg.ParseSourceMap(server.SourceMap)
+	assert.NoError(t, err)
+	return server.JS, sourceMap
+}
+
+func TestRuntimePoolRender(t *testing.T) {
+	js, sourceMap := buildTestServer(t)
+	pool := pkg.NewRuntimePool(js, sourceMap, 2)
+	defer pool.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			html, err := pool.Render(context.Background(), pkg.RenderRequest{
+				Path:  "/test",
+				Props: map[string]interface{}{"name": "Luna"},
+				Store: map[string]interface{}{"user": "moon"},
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, "<h1>/test</h1><p>Luna</p><p>moon</p>", html)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRuntimePoolReload(t *testing.T) {
+	js, sourceMap := buildTestServer(t)
+	pool := pkg.NewRuntimePool(js, sourceMap, 1)
+	defer pool.Close()
+
+	w, err := pool.Acquire(context.Background())
+	assert.NoError(t, err)
+
+	pool.Reload(`export function render(path) { return { html: "reloaded " + path }; }`, nil)
+	// the checked out runtime keeps the old bundle until it is released
+	html, err := w.Render(pkg.RenderRequest{Path: "/"})
+	assert.NoError(t, err)
+	assert.Equal(t, "<h1>/</h1><p></p><p></p>", html)
+	pool.Release(w)
+
+	html, err = pool.Render(context.Background(), pkg.RenderRequest{Path: "/"})
+	assert.NoError(t, err)
+	assert.Equal(t, "reloaded /", html)
+}
+
+// newEngine initializes a production engine on the test assets after configure adjusted its config
+func newEngine(t *testing.T, configure func(config *luna.Config)) *luna.Engine {
+	config := luna.Config{
+		ENV:              "production",
+		AssetsPath:       "./assets",
+		ServerEntryPoint: "./assets/entry-server.js",
+		ClientEntryPoint: "./assets/entry-client.js",
+		RenderPoolSize:   1,
+	}
+	configure(&config)
+	app, err := luna.New(config)
+	assert.NoError(t, err)
+	assert.NoError(t, app.InitializeFrontend())
+	return app
+}
+
+func newTestEngine(t *testing.T, routes ...pkg.ReactRoute) *luna.Engine {
+	return newEngine(t, func(config *luna.Config) {
+		config.Routes = routes
+	})
+}
+
+func serve(app *luna.Engine, method, target string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	rec := httptest.NewRecorder()
+	app.Server.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestHashedClientAssets(t *testing.T) {
+	app := newTestEngine(t, pkg.ReactRoute{Path: "/"})
+
+	rec := serve(app, http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	src := regexp.MustCompile(`<script src="(/_luna/client\.[A-Z0-9]+\.js)"`).FindStringSubmatch(rec.Body.String())
+	if assert.Len(t, src, 2) {
+		asset := serve(app, http.MethodGet, src[1])
+		assert.Equal(t, http.StatusOK, asset.Code)
+		assert.Contains(t, asset.Header().Get(echo.HeaderCacheControl), "immutable")
+		assert.Contains(t, asset.Body.String(), "import(")
+	}
+	assert.Regexp(t, `<link id="__LUNA_CSS__" href="/_luna/client\.[A-Z0-9]+\.css" rel="stylesheet" />`, rec.Body.String())
+	assert.Equal(t, http.StatusNotFound, serve(app, http.MethodGet, "/_luna/missing.js").Code)
+}
+
+func TestRouteChunkPreloads(t *testing.T) {
+	app := newTestEngine(t,
+		pkg.ReactRoute{Path: "/", Component: "./assets/pages/home.js"},
+		pkg.ReactRoute{Path: "/other"},
+	)
+
+	home := serve(app, http.MethodGet, "/").Body.String()
+	other := serve(app, http.MethodGet, "/other").Body.String()
+	preload := regexp.MustCompile(`<link href="(/_luna/chunk\.[A-Z0-9]+\.js)" rel="modulepreload" />`)
+
+	// the shared chunk is needed by every page, the page chunk only by its own route
+	assert.Len(t, preload.FindAllString(home, -1), 2)
+	assert.Len(t, preload.FindAllString(other, -1), 1)
+	for _, match := range preload.FindAllStringSubmatch(home, -1) {
+		assert.Equal(t, http.StatusOK, serve(app, http.MethodGet, match[1]).Code)
+	}
+}
+
+func TestStreamingRender(t *testing.T) {
+	app := newTestEngine(t, pkg.ReactRoute{
+		Path:   "/stream",
+		Stream: true,
+		Props: func(_ echo.Context, _ map[string]string) map[string]interface{} {
+			return map[string]interface{}{"name": "Luna"}
+		},
+	})
+
+	rec := serve(app, http.MethodGet, "/stream")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.True(t, rec.Flushed)
+	assert.Contains(t, rec.Body.String(), `<div id="root"><h1>/stream</h1><p>Luna</p></div>`)
+	assert.Contains(t, rec.Body.String(), "</html>")
+}
+
+func TestRenderLimits(t *testing.T) {
+	js, sourceMap := buildTestServer(t)
+	pool := pkg.NewRuntimePool(js, sourceMap, 1)
+	defer pool.Close()
+
+	cases := map[string]struct {
+		limits pkg.RenderLimits
+		want   error
+		stream bool
+	}{
+		"/loop":  {pkg.RenderLimits{Timeout: 100 * time.Millisecond}, pkg.ErrRenderTimeout, false},
+		"/alloc": {pkg.RenderLimits{Timeout: 10 * time.Second, MemoryLimit: 16 << 20}, pkg.ErrRenderMemory, false},
+		"/deep":  {pkg.RenderLimits{Timeout: 10 * time.Second, MaxStackSize: 256 << 10}, pkg.ErrRenderStack, false},
+		// awaiting a promise never reaches the interrupt handler
+		"/pending": {pkg.RenderLimits{Timeout: 100 * time.Millisecond}, pkg.ErrRenderTimeout, true},
+		"/sleep":   {pkg.RenderLimits{Timeout: 100 * time.Millisecond}, pkg.ErrRenderTimeout, true},
+	}
+	for path, tc := range cases {
+		var err error
+		started := time.Now()
+		if tc.stream {
+			err = pool.RenderStream(context.Background(), pkg.RenderRequest{Path: path, Limits: tc.limits}, func(string) error { return nil })
+		} else {
+			_, err = pool.Render(context.Background(), pkg.RenderRequest{Path: path, Limits: tc.limits})
+		}
+		assert.Less(t, time.Since(started), 2*time.Second, path)
+		var limitErr *pkg.RenderLimitError
+		assert.ErrorAs(t, err, &limitErr, path)
+		assert.ErrorIs(t, err, tc.want, path)
+
+		// the runtime is replaced and keeps serving renders
+		html, err := pool.Render(context.Background(), pkg.RenderRequest{Path: "/"})
+		assert.NoError(t, err)
+		assert.Equal(t, "<h1>/</h1><p></p><p></p>", html)
+	}
+
+	// timers still fire within the deadline
+	var chunks []string
+	err := pool.RenderStream(context.Background(), pkg.RenderRequest{Path: "/tick", Limits: pkg.RenderLimits{Timeout: time.Second}}, func(chunk string) error {
+		chunks = append(chunks, chunk)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"<h1>/tick</h1>", "<p></p>"}, chunks)
+}
+
+func TestRenderError(t *testing.T) {
+	js, sourceMap := buildTestServer(t)
+	pool := pkg.NewRuntimePool(js, sourceMap, 1)
+	defer pool.Close()
+
+	// production bundles are minified but keep their lines
+	server, err := pkg.JobRunner{ServerEntryPoint: "./assets/entry-server.js", Env: "production"}.BuildServer()
+	assert.NoError(t, err)
+	productionMap, err := pkg.ParseSourceMap(server.SourceMap)
+	assert.NoError(t, err)
+	production := pkg.NewRuntimePool(server.JS, productionMap, 1)
+	defer production.Close()
+
+	var renderErr *pkg.RenderError
+	for _, pool := range []*pkg.RuntimePool{pool, production} {
+		_, err := pool.Render(context.Background(), pkg.RenderRequest{Path: "/throw"})
+		if assert.ErrorAs(t, err, &renderErr) {
+			assert.Equal(t, "/throw", renderErr.Path)
+			assert.Equal(t, "TypeError", renderErr.Name)
+			assert.Equal(t, "boom", renderErr.Message)
+			assert.Contains(t, renderErr.Stack, "at fail (assets/entry-server.js:6)")
+			// the location points at the original source, not into the bundle
+			assert.Equal(t, "assets/entry-server.js", renderErr.File)
+			assert.Equal(t, 6, renderErr.Line)
+			// QuickJS reports no column, none is made up
+			assert.Equal(t, 0, renderErr.Column)
+		}
+	}
+
+	broken := pkg.NewRuntimePool("export const render = ;", nil, 1)
+	defer broken.Close()
+	_, err = broken.Render(context.Background(), pkg.RenderRequest{Path: "/"})
+	assert.ErrorAs(t, err, &renderErr)
+}
+
+func TestRenderErrorHandler(t *testing.T) {
+	app := newTestEngine(t, pkg.ReactRoute{Path: "/throw"})
+	var handled error
+	app.Server.HTTPErrorHandler = func(err error, c echo.Context) {
+		handled = err
+		app.Server.DefaultHTTPErrorHandler(err, c)
+	}
+
+	rec := serve(app, http.MethodGet, "/throw")
+	assert.Equal(t, http.StatusInternalServerError, rec.Code)
+	var renderErr *pkg.RenderError
+	assert.ErrorAs(t, handled, &renderErr)
+}
+
+func TestSSRFallback(t *testing.T) {
+	fail := false
+	var notified []string
+	app := newEngine(t, func(config *luna.Config) {
+		config.OnSSRFallback = func(route pkg.ReactRoute, path string, err error) {
+			notified = append(notified, path)
+		}
+		config.Routes = []pkg.ReactRoute{
+			{Path: "/throw", SSRFallback: pkg.SSRFallbackClientOnly},
+			{
+				Path:        "/flaky",
+				SSRFallback: pkg.SSRFallbackLastGood,
+				Props: func(_ echo.Context, _ map[string]string) map[string]interface{} {
+					return map[string]interface{}{"name": "good", "fail": fail}
+				},
+			},
+		}
+	})
+
+	rec := serve(app, http.MethodGet, "/throw")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `<div id="root" data-client-only></div>`)
+
+	rec = serve(app, http.MethodGet, "/flaky")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<p>good</p>")
+
+	fail = true
+	rec = serve(app, http.MethodGet, "/flaky")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `<div id="root"><h1>/flaky</h1><p>good</p>`)
+
+	assert.Equal(t, map[string]uint64{"/throw": 1, "/flaky": 1}, app.SSRFallbacks())
+	assert.Equal(t, []string{"/throw", "/flaky"}, notified)
+}
+
+func TestSSRFallbackLastGoodVariants(t *testing.T) {
+	fail := false
+	flaky := func(path string, vary pkg.CacheVary) pkg.ReactRoute {
+		return pkg.ReactRoute{
+			Path:        path,
+			SSRFallback: pkg.SSRFallbackLastGood,
+			CacheVary:   vary,
+			Props: func(c echo.Context, _ map[string]string) map[string]interface{} {
+				return map[string]interface{}{"name": c.QueryParam("user"), "fail": fail}
+			},
+		}
+	}
+	app := newEngine(t, func(config *luna.Config) {
+		config.Store = func(c echo.Context) map[string]interface{} {
+			return map[string]interface{}{"user": c.QueryParam("user")}
+		}
+		config.Routes = []pkg.ReactRoute{
+			flaky("/shared", pkg.CacheVary{Query: []string{"user"}, SharedStore: true}),
+			flaky("/private", pkg.CacheVary{Query: []string{"user"}}),
+		}
+	})
+
+	for _, path := range []string{"/shared", "/private"} {
+		assert.Contains(t, serve(app, http.MethodGet, path+"?user=ann").Body.String(), "<p>ann</p>")
+	}
+
+	fail = true
+	// every variant falls back to its own render
+	assert.Contains(t, serve(app, http.MethodGet, "/shared?user=ann").Body.String(), "<p>ann</p>")
+	assert.Contains(t, serve(app, http.MethodGet, "/shared?user=bob").Body.String(), `<div id="root" data-client-only></div>`)
+	// a per-request store keeps no render to fall back to
+	assert.Contains(t, serve(app, http.MethodGet, "/private?user=ann").Body.String(), `<div id="root" data-client-only></div>`)
+}
+
+func TestIncrementalRebuild(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "entry.js")
+	assert.NoError(t, os.WriteFile(entry, []byte(`export function render() { return { html: "<p>one</p>" }; }`), 0644))
+
+	builder, err := pkg.NewBuilder(pkg.JobRunner{ServerEntryPoint: entry, ClientEntryPoint: entry})
+	assert.NoError(t, err)
+	defer builder.Dispose()
+
+	server, err := builder.BuildServer()
+	assert.NoError(t, err)
+	assert.Contains(t, server.JS, "<p>one</p>")
+
+	assert.NoError(t, os.WriteFile(entry, []byte(`export function render() { return { html: "<p>two</p>" }; }`), 0644))
+	server, err = builder.BuildServer()
+	assert.NoError(t, err)
+	assert.Contains(t, server.JS, "<p>two</p>")
+}
+
+func TestInitializeFrontendTwice(t *testing.T) {
+	app := newTestEngine(t, pkg.ReactRoute{Path: "/"})
+	routes := len(app.Server.Routes())
+
+	assert.NoError(t, app.InitializeFrontend())
+	assert.Len(t, app.Server.Routes(), routes)
+
+	// Builds from several goroutines, like the watcher racing an export, are serialized
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, app.InitializeFrontend())
+		}()
+	}
+	wg.Wait()
+	assert.Len(t, app.Server.Routes(), routes)
+
+	rec := serve(app, http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<h1>/</h1>")
+}
+
+func TestCSSOnlyRebuildKeepsClientEntry(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "entry.js")
+	style := filepath.Join(dir, "style.css")
+	assert.NoError(t, os.WriteFile(entry, []byte(`import "./style.css"; console.log("client");`), 0644))
+	assert.NoError(t, os.WriteFile(style, []byte(`p { color: red; }`), 0644))
+
+	builder, err := pkg.NewBuilder(pkg.JobRunner{ServerEntryPoint: entry, ClientEntryPoint: entry})
+	assert.NoError(t, err)
+	defer builder.Dispose()
+
+	before, err := builder.BuildClient()
+	assert.NoError(t, err)
+
+	// the dev script swaps the stylesheet in place when only its URL changed
+	assert.NoError(t, os.WriteFile(style, []byte(`p { color: blue; }`), 0644))
+	after, err := builder.BuildClient()
+	assert.NoError(t, err)
+	assert.Equal(t, before.JSPath, after.JSPath)
+	assert.NotEqual(t, before.CSSPath, after.CSSPath)
+	assert.Contains(t, after.CSS, "blue")
+}
+
+func TestBuildError(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "entry.js")
+	assert.NoError(t, os.WriteFile(entry, []byte("export function render() {\n  return {;\n}\n"), 0644))
+
+	_, err := pkg.JobRunner{ServerEntryPoint: entry}.BuildServer()
+	var buildErr *pkg.BuildError
+	if assert.ErrorAs(t, err, &buildErr) && assert.NotEmpty(t, buildErr.Messages) {
+		m := buildErr.Messages[0]
+		assert.Equal(t, 2, m.Line)
+		assert.Equal(t, 10, m.Column)
+		assert.Equal(t, "  return {;", m.LineText)
+		assert.Equal(t, "  1 | export function render() {\n> 2 |   return {;\n    |           ^\n  3 | }\n  4 | ", pkg.CodeFrame("export function render() {\n  return {;\n}\n", m.Line, m.Column))
+	}
+}
+
+func TestFirstBuildError(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "entry-server.js")
+	assert.NoError(t, os.WriteFile(entry, []byte("export function render() {\n  return {;\n}\n"), 0644))
+
+	for _, env := range []string{"production", "development"} {
+		app := newEngine(t, func(config *luna.Config) {
+			config.ENV = env
+			config.RootPath = dir
+			config.ServerEntryPoint = entry
+			config.Routes = []pkg.ReactRoute{{Path: "/"}}
+		})
+
+		// requests fail instead of panicking until a server build succeeds
+		rec := serve(app, http.MethodGet, "/")
+		assert.Equal(t, http.StatusInternalServerError, rec.Code, env)
+		if env == "development" {
+			assert.Contains(t, rec.Body.String(), "server bundle is empty")
+		}
+	}
+}
+
+func TestPrebuiltFrontend(t *testing.T) {
+	// built without an Engine, the way `luna build --server --client` does
+	dir := t.TempDir()
+	assert.NoError(t, pkg.Build(dir, pkg.BuildOptions{
+		ServerEntryPoint: "./assets/entry-server.js",
+		ClientEntryPoint: "./assets/entry-client.js",
+	}))
+	assert.FileExists(t, filepath.Join(dir, pkg.ManifestFile))
+
+	// the entry points are gone, everything comes from the build directory
+	app, err := luna.New(luna.Config{
+		ENV:              "production",
+		ServerEntryPoint: "./missing/entry-server.js",
+		ClientEntryPoint: "./missing/entry-client.js",
+		BuildPath:        dir,
+		AssetsPath:       "./assets",
+		TailwindCSS:      true, // its output is part of the build, no tailwind.config.js needed
+		RenderPoolSize:   1,
+		Routes:           []pkg.ReactRoute{{Path: "/", Component: "./assets/pages/home.js"}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, app.CheckApp(app.Config))
+	assert.NoError(t, app.InitializeFrontend())
+
+	rec := serve(app, http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<h1>/</h1>")
+	assert.Regexp(t, `<link href="/_luna/chunk\.[A-Z0-9]+\.js" rel="modulepreload" />`, rec.Body.String())
+	src := regexp.MustCompile(`<script src="(/_luna/client\.[A-Z0-9]+\.js)"`).FindStringSubmatch(rec.Body.String())
+	if assert.Len(t, src, 2) {
+		assert.Equal(t, http.StatusOK, serve(app, http.MethodGet, src[1]).Code)
+	}
+}
+
+func TestEmbeddedFrontend(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, newTestEngine(t).Build(dir))
+
+	fsys := fstest.MapFS{
+		"public/robots.txt": {Data: []byte("User-agent: *")},
+		"static/logo.svg":   {Data: []byte("<svg></svg>")},
+	}
+	assert.NoError(t, filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(dir, path)
+		fsys["dist/"+filepath.ToSlash(rel)] = &fstest.MapFile{Data: data}
+		return err
+	}))
+
+	app, err := luna.New(luna.Config{
+		ENV:            "production",
+		FS:             fsys,
+		BuildPath:      "dist",
+		AssetsPath:     "static",
+		PublicPath:     "public/",
+		RenderPoolSize: 1,
+		Routes:         []pkg.ReactRoute{{Path: "/"}},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, app.InitializeFrontend())
+
+	rec := serve(app, http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "<h1>/</h1>")
+	assert.Equal(t, "User-agent: *", serve(app, http.MethodGet, "/robots.txt").Body.String())
+	assert.Equal(t, "<svg></svg>", serve(app, http.MethodGet, "/assets/logo.svg").Body.String())
+}
+
+func TestExport(t *testing.T) {
+	app := newTestEngine(t,
+		pkg.ReactRoute{Path: "/"},
+		pkg.ReactRoute{
+			Path: "/decks/:id",
+			Props: func(_ echo.Context, params map[string]string) map[string]interface{} {
+				return map[string]interface{}{"name": "deck " + params["id"]}
+			},
+			StaticPaths: func() []string {
+				return []string{"/decks/1", "/decks/2", "/decks/hello world"}
+			},
+		},
+		pkg.ReactRoute{Path: "/users/:id"},
+	)
+	dir := t.TempDir()
+	assert.NoError(t, app.Export(dir))
+
+	for file, content := range map[string]string{
+		"index.html":                   "<h1>/</h1>",
+		"decks/1/index.html":           "<p>deck 1</p>",
+		"decks/2/index.html":           "<p>deck 2</p>",
+		"decks/hello world/index.html": "<p>deck hello world</p>",
+	} {
+		html, err := os.ReadFile(filepath.Join(dir, file))
+		if assert.NoError(t, err, file) {
+			assert.Contains(t, string(html), content)
+		}
+	}
+	assert.NoDirExists(t, filepath.Join(dir, "users"))
+	assert.FileExists(t, filepath.Join(dir, "assets", "entry-server.js"))
+
+	html, _ := os.ReadFile(filepath.Join(dir, "index.html"))
+	src := regexp.MustCompile(`<script src="/_luna/(client\.[A-Z0-9]+\.js)"`).FindStringSubmatch(string(html))
+	if assert.Len(t, src, 2) {
+		assert.FileExists(t, filepath.Join(dir, "_luna", src[1]))
+	}
+
+	invalid := newTestEngine(t, pkg.ReactRoute{
+		Path:        "/decks/:id",
+		StaticPaths: func() []string { return []string{"/decks/%zz"} },
+	})
+	assert.ErrorContains(t, invalid.Export(t.TempDir()), "exporting /decks/%zz")
+}
+
+func TestRevalidate(t *testing.T) {
+	var renders atomic.Int32
+	props := func(_ echo.Context, _ map[string]string) map[string]interface{} {
+		return map[string]interface{}{"name": fmt.Sprintf("render %d", renders.Add(1))}
+	}
+	app := newTestEngine(t,
+		pkg.ReactRoute{Path: "/news", Revalidate: 50 * time.Millisecond, Props: props},
+		pkg.ReactRoute{Path: "/about", CacheExpiry: time.Now().Add(time.Hour).Unix(), CacheTags: []string{"pages"}, Props: props},
+	)
+	body := func(path string) string {
+		return serve(app, http.MethodGet, path).Body.String()
+	}
+
+	assert.Contains(t, body("/news"), "<p>render 1</p>")
+	assert.Contains(t, body("/news"), "<p>render 1</p>")
+
+	// the stale page is served once more while it renders again
+	time.Sleep(60 * time.Millisecond)
+	assert.Contains(t, body("/news"), "<p>render 1</p>")
+	assert.Eventually(t, func() bool {
+		return strings.Contains(body("/news"), "<p>render 2</p>")
+	}, time.Second, 10*time.Millisecond)
+
+	assert.Contains(t, body("/about"), "<p>render 3</p>")
+	app.RevalidateTag("pages")
+	assert.Eventually(t, func() bool {
+		return strings.Contains(body("/about"), "<p>render 4</p>")
+	}, time.Second, 10*time.Millisecond)
+	app.Revalidate("/about")
+	assert.Eventually(t, func() bool {
+		return strings.Contains(body("/about"), "<p>render 5</p>")
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int32(5), renders.Load())
+}
+
+func TestRevalidateEscapedPath(t *testing.T) {
+	var renders atomic.Int32
+	app := newTestEngine(t, pkg.ReactRoute{
+		Path:        "/posts/:slug",
+		CachePolicy: pkg.CachePolicy{TTL: 50 * time.Millisecond, StaleWhileRevalidate: time.Hour},
+		Props: func(_ echo.Context, params map[string]string) map[string]interface{} {
+			return map[string]interface{}{"name": fmt.Sprintf("%s %d", params["slug"], renders.Add(1))}
+		},
+	})
+	body := func() string {
+		return serve(app, http.MethodGet, "/posts/hello%20world%3Fx").Body.String()
+	}
+
+	assert.Contains(t, body(), "<p>hello world?x 1</p>")
+	time.Sleep(60 * time.Millisecond)
+	assert.Contains(t, body(), "<p>hello world?x 1</p>")
+	// the background render requests the same page again
+	assert.Eventually(t, func() bool {
+		return strings.Contains(body(), "<p>hello world?x 2</p>")
+	}, time.Second, 10*time.Millisecond)
+}
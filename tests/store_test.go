@@ -0,0 +1,448 @@
+package luna
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Djancyp/luna"
+	"github.com/Djancyp/luna/pkg"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRedis serves the subset of the Redis protocol RedisStore uses
+type fakeRedis struct {
+	addr   string
+	mu     sync.Mutex
+	data   map[string]fakeRedisValue
+	hashes map[string]map[string]string
+	subs   map[string][]*fakeRedisConn
+}
+
+type fakeRedisValue struct {
+	value   string
+	expires time.Time
+}
+
+type fakeRedisConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *fakeRedisConn) reply(format string, args ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(c, format, args...)
+}
+
+func bulk(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+func startFakeRedis(t *testing.T) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	t.Cleanup(func() { l.Close() })
+	server := &fakeRedis{addr: l.Addr().String(), data: map[string]fakeRedisValue{}, hashes: map[string]map[string]string{}, subs: map[string][]*fakeRedisConn{}}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(&fakeRedisConn{Conn: conn})
+		}
+	}()
+	return server
+}
+
+func (s *fakeRedis) serve(conn *fakeRedisConn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		s.handle(conn, args)
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+// get returns a live value, s.mu must be held
+func (s *fakeRedis) get(key string) (string, bool) {
+	value, ok := s.data[key]
+	if ok && !value.expires.IsZero() && time.Now().After(value.expires) {
+		delete(s.data, key)
+		return "", false
+	}
+	return value.value, ok
+}
+
+func (s *fakeRedis) handle(conn *fakeRedisConn, args []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		conn.reply("+OK\r\n")
+	case "GET":
+		if value, ok := s.get(args[1]); ok {
+			conn.reply("%s", bulk(value))
+		} else {
+			conn.reply("$-1\r\n")
+		}
+	case "SET":
+		value := fakeRedisValue{value: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, _ := strconv.Atoi(args[4])
+			value.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.data[args[1]] = value
+		conn.reply("+OK\r\n")
+	case "DEL":
+		removed := 0
+		for _, key := range args[1:] {
+			if _, ok := s.get(key); ok {
+				delete(s.data, key)
+				removed++
+			}
+		}
+		conn.reply(":%d\r\n", removed)
+	case "HSET":
+		if s.hashes[args[1]] == nil {
+			s.hashes[args[1]] = map[string]string{}
+		}
+		s.hashes[args[1]][args[2]] = args[3]
+		conn.reply(":1\r\n")
+	case "HDEL":
+		removed := 0
+		for _, field := range args[2:] {
+			if _, ok := s.hashes[args[1]][field]; ok {
+				delete(s.hashes[args[1]], field)
+				removed++
+			}
+		}
+		conn.reply(":%d\r\n", removed)
+	case "HGETALL":
+		hash := s.hashes[args[1]]
+		reply := fmt.Sprintf("*%d\r\n", 2*len(hash))
+		for field, value := range hash {
+			reply += bulk(field) + bulk(value)
+		}
+		conn.reply("%s", reply)
+	case "SUBSCRIBE":
+		s.subs[args[1]] = append(s.subs[args[1]], conn)
+		conn.reply("*3\r\n%s%s:1\r\n", bulk("subscribe"), bulk(args[1]))
+	case "PUBLISH":
+		subs := s.subs[args[1]]
+		for _, sub := range subs {
+			sub.reply("*3\r\n%s%s%s", bulk("message"), bulk(args[1]), bulk(args[2]))
+		}
+		conn.reply(":%d\r\n", len(subs))
+	default:
+		conn.reply("-ERR unknown command '%s'\r\n", args[0])
+	}
+}
+
+func countingRoute(path string, renders *atomic.Int32) pkg.ReactRoute {
+	return pkg.ReactRoute{
+		Path:        path,
+		CachePolicy: pkg.CachePolicy{TTL: time.Hour},
+		CacheTags:   []string{"pages"},
+		Props: func(_ echo.Context, _ map[string]string) map[string]interface{} {
+			return map[string]interface{}{"name": fmt.Sprintf("render %d", renders.Add(1))}
+		},
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pkg.NewFileStore(dir)
+	assert.NoError(t, err)
+	var renders atomic.Int32
+	app := newEngine(t, func(config *luna.Config) {
+		config.PageCache = pkg.CacheOptions{Store: store}
+		config.Routes = []pkg.ReactRoute{countingRoute("/", &renders)}
+	})
+
+	assert.Contains(t, serve(app, http.MethodGet, "/").Body.String(), "<p>render 1</p>")
+
+	// a restarted process finds the page on disk
+	reopened, err := pkg.NewFileStore(dir)
+	assert.NoError(t, err)
+	restarted := newEngine(t, func(config *luna.Config) {
+		config.PageCache = pkg.CacheOptions{Store: reopened}
+		config.Routes = []pkg.ReactRoute{countingRoute("/", &renders)}
+	})
+	assert.Contains(t, serve(restarted, http.MethodGet, "/").Body.String(), "<p>render 1</p>")
+	assert.Equal(t, 1, restarted.CacheStats().Entries)
+
+	assert.Equal(t, 1, restarted.InvalidateTags("pages"))
+	assert.Contains(t, serve(app, http.MethodGet, "/").Body.String(), "<p>render 2</p>")
+}
+
+func TestFileStoreMaxAge(t *testing.T) {
+	store, err := pkg.NewFileStore(t.TempDir())
+	assert.NoError(t, err)
+	assert.NoError(t, store.Set(pkg.Cache{ID: "old:/", Path: "/"}))
+	assert.NoError(t, store.Set(pkg.Cache{ID: "new:/", Path: "/"}))
+
+	// the page of a previous build was written a day ago
+	old := time.Now().Add(-25 * time.Hour)
+	files, err := filepath.Glob(filepath.Join(store.Dir, "*.json"))
+	assert.NoError(t, err)
+	for _, file := range files {
+		if cache, err := os.ReadFile(file); err == nil && strings.Contains(string(cache), "old:/") {
+			assert.NoError(t, os.Chtimes(file, old, old))
+		}
+	}
+
+	_, found, err := store.Get("old:/")
+	assert.NoError(t, err)
+	assert.False(t, found)
+	_, found, err = store.Get("new:/")
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	// the sweeper drops the rest once they are as old
+	files, err = filepath.Glob(filepath.Join(store.Dir, "*.json"))
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.NoError(t, os.Chtimes(files[0], old, old))
+	assert.NoError(t, store.DeleteExpired())
+	stats, err := store.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 0, stats.Entries)
+}
+
+func TestFileStoreRebuild(t *testing.T) {
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "entry-client.js")
+	assert.NoError(t, os.WriteFile(entry, []byte(`console.log("one");`), 0644))
+	store, err := pkg.NewFileStore(filepath.Join(dir, "cache"))
+	assert.NoError(t, err)
+	var renders atomic.Int32
+	app := newEngine(t, func(config *luna.Config) {
+		config.ClientEntryPoint = entry
+		config.PageCache = pkg.CacheOptions{Store: store}
+		config.Routes = []pkg.ReactRoute{countingRoute("/", &renders)}
+	})
+	script := regexp.MustCompile(pkg.AssetsPrefix + `[^"]+\.js`)
+
+	first := serve(app, http.MethodGet, "/").Body.String()
+	assert.Contains(t, first, "<p>render 1</p>")
+	assert.Equal(t, first, serve(app, http.MethodGet, "/").Body.String())
+
+	// the page kept on disk points at the previous client script
+	assert.NoError(t, os.WriteFile(entry, []byte(`console.log("two");`), 0644))
+	assert.NoError(t, app.InitializeFrontend())
+	second := serve(app, http.MethodGet, "/").Body.String()
+	assert.Contains(t, second, "<p>render 2</p>")
+	assert.NotEqual(t, script.FindString(first), script.FindString(second))
+	assert.Equal(t, http.StatusOK, serve(app, http.MethodGet, script.FindString(second)).Code)
+}
+
+func TestFileStoreCredentials(t *testing.T) {
+	dir := t.TempDir()
+	store, err := pkg.NewFileStore(dir)
+	assert.NoError(t, err)
+	var renders atomic.Int32
+	app := newEngine(t, func(config *luna.Config) {
+		config.PageCache = pkg.CacheOptions{Store: store}
+		config.Routes = []pkg.ReactRoute{{
+			Path:        "/",
+			CachePolicy: pkg.CachePolicy{TTL: 50 * time.Millisecond, StaleWhileRevalidate: time.Hour},
+			CacheVary:   pkg.CacheVary{Cookies: []string{"session"}},
+			Props: func(c echo.Context, _ map[string]string) map[string]interface{} {
+				_, err := c.Cookie("session")
+				return map[string]interface{}{"name": fmt.Sprintf("%d signed in %t", renders.Add(1), err == nil)}
+			},
+		}}
+	})
+	get := func() string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.AddCookie(&http.Cookie{Name: "session", Value: "s3cr3t"})
+		rec := httptest.NewRecorder()
+		app.Server.ServeHTTP(rec, req)
+		return rec.Body.String()
+	}
+	assert.Contains(t, get(), "<p>1 signed in true</p>")
+
+	// the cookie shows neither in the key nor on disk
+	files, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		assert.NoError(t, err)
+		assert.NotContains(t, string(data), "s3cr3t")
+	}
+	if assert.Len(t, app.CacheEntries(), 1) {
+		assert.NotContains(t, app.CacheEntries()[0].ID, "s3cr3t")
+	}
+
+	// a stale page is rendered again with the cookies of the request that found it
+	time.Sleep(60 * time.Millisecond)
+	assert.Contains(t, get(), "<p>1 signed in true</p>")
+	assert.Eventually(t, func() bool {
+		return strings.Contains(get(), "<p>2 signed in true</p>")
+	}, time.Second, 10*time.Millisecond)
+
+	// without a request to take them from the page is purged instead
+	app.Revalidate("/")
+	assert.Equal(t, 0, app.CacheStats().Entries)
+}
+
+func TestRedisStore(t *testing.T) {
+	server := startFakeRedis(t)
+	var renders atomic.Int32
+	replica := func() *luna.Engine {
+		store := pkg.NewRedisStore(pkg.RedisOptions{Addr: server.addr, Password: "secret"})
+		t.Cleanup(func() { store.Close() })
+		return newEngine(t, func(config *luna.Config) {
+			config.PageCache = pkg.CacheOptions{Store: store}
+			config.Routes = []pkg.ReactRoute{countingRoute("/", &renders), countingRoute("/about", &renders)}
+		})
+	}
+	a, b := replica(), replica()
+
+	assert.Contains(t, serve(a, http.MethodGet, "/").Body.String(), "<p>render 1</p>")
+	assert.Contains(t, serve(b, http.MethodGet, "/").Body.String(), "<p>render 1</p>")
+	assert.Contains(t, serve(b, http.MethodGet, "/about").Body.String(), "<p>render 2</p>")
+	assert.Equal(t, 2, a.CacheStats().Entries)
+	assert.Len(t, a.CacheEntries(), 2)
+
+	assert.Equal(t, 1, a.Purge("/"))
+	assert.Contains(t, serve(b, http.MethodGet, "/").Body.String(), "<p>render 3</p>")
+	assert.Contains(t, serve(a, http.MethodGet, "/about").Body.String(), "<p>render 2</p>")
+}
+
+func TestRedisStoreMeta(t *testing.T) {
+	server := startFakeRedis(t)
+	store := pkg.NewRedisStore(pkg.RedisOptions{Addr: server.addr})
+	defer store.Close()
+
+	page := pkg.Cache{ID: "build:/", Path: "/", Tags: []string{"pages"}, Page: []byte(strings.Repeat("x", 1000))}
+	assert.NoError(t, store.Set(page))
+	short := pkg.Cache{ID: "build:/short", Path: "/short", Expires: time.Now().Add(20 * time.Millisecond)}
+	assert.NoError(t, store.Set(short))
+
+	// a page that never expires still leaves Redis once the next builds took over
+	server.mu.Lock()
+	expires := server.data["luna:page:build:/"].expires
+	server.mu.Unlock()
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), expires, time.Minute)
+
+	// listing reads the meta hash, not the pages
+	entries, err := store.Entries()
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Empty(t, entry.Page)
+		if entry.Path == "/" {
+			assert.Equal(t, int64(len(page.ID)+len(page.Page)), entry.Entry().Bytes)
+		}
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	stats, err := store.Stats()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, stats.Entries)
+	assert.NoError(t, store.DeleteExpired())
+	server.mu.Lock()
+	assert.Len(t, server.hashes["luna:meta"], 1)
+	server.mu.Unlock()
+
+	removed, err := store.Delete(pkg.Invalidation{Tags: []string{"pages"}}.Match)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	_, found, err := store.Get(page.ID)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	server.mu.Lock()
+	assert.Empty(t, server.hashes["luna:meta"])
+	server.mu.Unlock()
+}
+
+func TestRedisStoreTimeout(t *testing.T) {
+	// a server that accepts connections and never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	store := pkg.NewRedisStore(pkg.RedisOptions{Addr: l.Addr().String(), Timeout: 50 * time.Millisecond})
+	defer store.Close()
+	started := time.Now()
+	_, _, err = store.Get("/")
+	var netErr net.Error
+	if assert.ErrorAs(t, err, &netErr) {
+		assert.True(t, netErr.Timeout())
+	}
+	assert.Less(t, time.Since(started), time.Second)
+}
+
+func TestCacheBus(t *testing.T) {
+	server := startFakeRedis(t)
+	var renders atomic.Int32
+	replica := func() *luna.Engine {
+		bus := pkg.NewRedisStore(pkg.RedisOptions{Addr: server.addr})
+		t.Cleanup(func() { bus.Close() })
+		// every replica keeps its pages in memory, only invalidations go through Redis
+		return newEngine(t, func(config *luna.Config) {
+			config.PageCache = pkg.CacheOptions{Bus: bus}
+			config.Routes = []pkg.ReactRoute{countingRoute("/", &renders)}
+		})
+	}
+	a, b := replica(), replica()
+
+	assert.Contains(t, serve(a, http.MethodGet, "/").Body.String(), "<p>render 1</p>")
+	assert.Contains(t, serve(b, http.MethodGet, "/").Body.String(), "<p>render 2</p>")
+
+	assert.Equal(t, 1, a.InvalidateTags("pages"))
+	assert.Eventually(t, func() bool {
+		return b.CacheStats().Entries == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Contains(t, serve(b, http.MethodGet, "/").Body.String(), "<p>render 3</p>")
+}
@@ -1,7 +1,11 @@
 package luna
 
 import (
+	"io/fs"
+	"sync"
+	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/Djancyp/luna/pkg"
 	"github.com/labstack/echo/v4"
@@ -12,11 +16,30 @@ type PropsResponse struct {
 	Path string `json:"path"`
 }
 type Engine struct {
-	Logger    zerolog.Logger
-	Server    *echo.Echo
-	Config    Config
-	Cache     []Cache
-	HotReload *HotReload
+	Logger       zerolog.Logger
+	Server       *echo.Echo
+	Config       Config
+	Cache        []Cache
+	HotReload    *HotReload
+	renderer     *pkg.RuntimePool
+	assets       *pkg.StaticAssets
+	bundler      pkg.Bundler
+	frontend     atomic.Pointer[frontend] // swapped as a whole on every build
+	buildMu      sync.Mutex               // serializes builds and guards routed
+	routed       bool                     // the page route is registered
+	tailwindCSS  string                   // output of the last Tailwind run, kept while no file it scans changes
+	lastGood     *pkg.MemoryStore         // last successful server render per cache ID, for SSRFallbackLastGood routes
+	fallbacks    sync.Map                 // route path -> *atomic.Uint64 count of served fallbacks
+	revalidating sync.Map                 // cache ID -> struct{} while the page is rendered again in the background
+}
+
+// frontend is the client build and page cache a request is served from
+type frontend struct {
+	client    pkg.BuildResult
+	build     string // identifies the client output, prefixes the IDs of cached pages
+	cache     *pkg.Manager
+	sourceMap *pkg.SourceMap // source map of the server bundle in use
+	err       error          // errors of the latest build, the previous output keeps being served
 }
 
 type Cache struct {
@@ -36,9 +59,19 @@ type Config struct {
 	FaviconPath         string `default:"frontend/src/assets/favicon.ico"`
 	AssetsPath          string `default:"frontend/src/assets/"`
 	PublicPath          string `default:"public/"`
+	BuildPath           string // directory written by `luna build`, its bundles are loaded instead of building at start
+	FS                  fs.FS  // when set, BuildPath, AssetsPath and PublicPath are read from it instead of the disk, e.g. an embed.FS
 	TailwindCSS         bool   `default:"false"`
 	Head                pkg.MainHead
-	HotReloadServerPort int `default:"8080"`
+	HotReloadServerPort int                                                `default:"8080"`      // Deprecated: unused, the websocket is served by Engine.Server at HotReloadPath
+	HotReloadPath       string                                             `default:"/_luna/ws"` // route of the hot reload websocket outside production
+	WatchInclude        []string                                           // globs relative to RootPath that trigger a rebuild, all files when empty
+	WatchExclude        []string                                           // globs relative to RootPath ignored on top of node_modules, .git and editor temp files
+	WatchDebounce       time.Duration                                      `default:"100ms"` // quiet period that coalesces a burst of changes into one rebuild
+	RenderPoolSize      int                                                `default:"0"`     // number of pre-warmed JS runtimes, 0 uses the number of CPUs
+	RenderLimits        pkg.RenderLimits                                   // default limits of a server render, routes can override them
+	PageCache           pkg.CacheOptions                                   // bounds, store and replica bus of the page cache
+	OnSSRFallback       func(route pkg.ReactRoute, path string, err error) // called whenever a route serves its SSR fallback
 	Store               pkg.Store
 	Routes              []pkg.ReactRoute
 }